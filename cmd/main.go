@@ -32,6 +32,10 @@ func main() {
 		rootPath = os.Args[2]
 	}
 
+	// Reuse one parser for every file in the walk
+	parser := grepast.NewParser()
+	defer parser.Close()
+
 	// Walk the directory
 	err = filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
 		// Skip errors
@@ -52,7 +56,7 @@ func main() {
 			return nil
 		}
 
-		parseAndGrep(rel, searchQuery)
+		parseAndGrep(parser, rel, searchQuery)
 		return nil
 	})
 
@@ -62,14 +66,14 @@ func main() {
 
 }
 
-func parseAndGrep(filePath, search string) error {
+func parseAndGrep(parser *grepast.Parser, filePath, search string) error {
 	source, err := os.ReadFile(filePath)
 	if err != nil {
 		return fmt.Errorf("error reading file %s: %v", filePath, err)
 	}
 
 	// Attempt to create a TreeContext. Non-Go files may fail.
-	tc, err := grepast.NewTreeContext(filePath, source, grepast.TreeContextOptions{
+	tc, err := parser.Parse(filePath, source, grepast.TreeContextOptions{
 		Color:                    true,
 		Verbose:                  false,
 		ShowLineNumber:           true,
@@ -85,6 +89,7 @@ func parseAndGrep(filePath, search string) error {
 	if err != nil {
 		return fmt.Errorf("error parsing file %s: %v", filePath, err)
 	}
+	defer tc.Close()
 
 	found := tc.Grep(search, false)
 	tc.AddLinesOfInterest(found)
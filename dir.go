@@ -0,0 +1,157 @@
+package grepast
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileResult is the outcome of grepping a single file in a directory walk. Callers own
+// Context and must Close it when done to free its parse tree.
+type FileResult struct {
+	Path    string           // Path relative to the walked root.
+	Context *TreeContext     // Context with lines of interest and context added; nil if Err is set.
+	Matches map[int]struct{} // Lines that matched the pattern.
+	Err     error            // Error reading or parsing the file.
+}
+
+// GrepDirConcurrent greps every supported file under root using a pool of workers, each
+// owning its own Parser. Files matching DefaultIgnorePatterns, files in unsupported languages
+// and binary files are skipped, as are files without matches. Results are sorted by path so
+// the output doesn't depend on scheduling. workers <= 0 uses one worker per CPU.
+func GrepDirConcurrent(root, pattern string, opts TreeContextOptions, workers int) ([]FileResult, error) {
+	re, err := compilePattern(pattern, false)
+	if err != nil {
+		return nil, err
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	paths := make(chan string)
+	results := make(chan FileResult)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// tree-sitter parsers can't be shared, so each worker gets its own
+			parser := NewParser()
+			defer parser.Close()
+			for rel := range paths {
+				if res, ok := grepFile(parser, root, rel, re, opts); ok {
+					results <- res
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	walkErr := make(chan error, 1)
+	go func() {
+		defer close(paths)
+		walkErr <- filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if rel != "." && MatchIgnorePattern(rel+"/", DefaultIgnorePatterns) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if MatchIgnorePattern(rel, DefaultIgnorePatterns) {
+				return nil
+			}
+			paths <- rel
+			return nil
+		})
+	}()
+
+	var out []FileResult
+	for res := range results {
+		out = append(out, res)
+	}
+	if err := <-walkErr; err != nil {
+		// the caller never sees these contexts, so free their parse trees here
+		for _, res := range out {
+			if res.Context != nil {
+				res.Context.Close()
+			}
+		}
+		return nil, err
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+// grepFile greps a single file for GrepDirConcurrent. It reports false for files that
+// should be left out of the results.
+func grepFile(parser *Parser, root, rel string, re *regexp.Regexp, opts TreeContextOptions) (FileResult, bool) {
+	source, err := os.ReadFile(filepath.Join(root, rel))
+	if err != nil {
+		return FileResult{Path: rel, Err: err}, true
+	}
+
+	tc, err := parser.Parse(rel, source, opts)
+	if err != nil {
+		if errors.Is(err, ErrorUnrecognizedFiletype) || errors.Is(err, ErrorUnsupportedLanguage) || errors.Is(err, ErrorBinaryFile) {
+			return FileResult{}, false
+		}
+		return FileResult{Path: rel, Err: err}, true
+	}
+
+	found := tc.grepRegexp(re)
+	if len(found) == 0 {
+		tc.Close()
+		return FileResult{}, false
+	}
+	tc.AddLinesOfInterest(found)
+	tc.AddContext()
+
+	return FileResult{Path: rel, Context: tc, Matches: found}, true
+}
+
+// FormatFiles formats several contexts as one report, ripgrep style: each file's snippet is
+// preceded by an "== filename ==" header (bold when that context has Color set), and files
+// are separated by a blank line. Files are emitted in filename order; nil contexts are skipped.
+func FormatFiles(results map[string]*TreeContext) string {
+	names := make([]string, 0, len(results))
+	for name, tc := range results {
+		if tc != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for n, name := range names {
+		tc := results[name]
+		if n > 0 {
+			sb.WriteString("\n")
+		}
+		if tc.color {
+			sb.WriteString("\033[1m== " + name + " ==\033[0m\n")
+		} else {
+			sb.WriteString("== " + name + " ==\n")
+		}
+		tc.formatTo(&sb)
+	}
+	return sb.String()
+}
@@ -0,0 +1,75 @@
+package grepast
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrepDirConcurrent(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.go":              "package main\n\nfunc a() {\n\tneedle()\n}\n",
+		"b.py":              "def b():\n    return 1\n",
+		"pkg/c.go":          "package pkg\n\nfunc c() {\n\tneedle()\n\tneedle()\n}\n",
+		"pkg/deep/d.rs":     "fn d() {\n    needle();\n}\n",
+		"notes.txt":         "needle in plain text is skipped\n",
+		"node_modules/e.js": "needle();\n",
+		"image.go":          "needle\x00\x00",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	for _, workers := range []int{1, 4} {
+		results, err := GrepDirConcurrent(root, "needle", TreeContextOptions{ShowParentContext: true}, workers)
+		assert.NoError(t, err)
+
+		var paths []string
+		matches := map[string]int{}
+		for _, res := range results {
+			assert.NoError(t, res.Err)
+			paths = append(paths, res.Path)
+			matches[res.Path] = len(res.Matches)
+			assert.Contains(t, res.Context.Format(), "needle")
+			res.Context.Close()
+		}
+		assert.Equal(t, []string{"a.go", filepath.Join("pkg", "c.go"), filepath.Join("pkg", "deep", "d.rs")}, paths)
+		assert.Equal(t, 2, matches[filepath.Join("pkg", "c.go")])
+	}
+
+	_, err := GrepDirConcurrent(root, "(", TreeContextOptions{}, 2)
+	assert.Error(t, err)
+}
+
+func TestFormatFiles(t *testing.T) {
+	newContext := func(name, source string, color bool) *TreeContext {
+		tc, err := NewTreeContext(name, []byte(source), TreeContextOptions{Color: color})
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep("needle", false))
+		tc.AddContext()
+		return tc
+	}
+
+	results := map[string]*TreeContext{
+		"b.py": newContext("b.py", "def b():\n    needle()\n", false),
+		"a.go": newContext("a.go", "package main\n\nfunc a() {\n\tneedle()\n}\n", false),
+	}
+	out := FormatFiles(results)
+
+	a, b := strings.Index(out, "== a.go ==\n"), strings.Index(out, "== b.py ==\n")
+	assert.True(t, a == 0, out)
+	assert.Greater(t, b, a, out)
+	assert.Equal(t, "\n\n", out[b-2:b], "files are separated by a blank line")
+	assert.Equal(t, results["a.go"].Format()+"\n", out[len("== a.go ==\n"):b])
+
+	colored := FormatFiles(map[string]*TreeContext{"a.go": newContext("a.go", "package main\n\nfunc a() {\n\tneedle()\n}\n", true)})
+	assert.True(t, strings.HasPrefix(colored, "\033[1m== a.go ==\033[0m\n"), colored)
+
+	assert.Empty(t, FormatFiles(nil))
+}
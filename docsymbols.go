@@ -0,0 +1,161 @@
+package grepast
+
+import (
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// SymbolKind is an LSP SymbolKind.
+type SymbolKind int
+
+// The LSP symbol kinds DocumentSymbols produces.
+const (
+	SymbolKindModule      SymbolKind = 2
+	SymbolKindNamespace   SymbolKind = 3
+	SymbolKindClass       SymbolKind = 5
+	SymbolKindMethod      SymbolKind = 6
+	SymbolKindConstructor SymbolKind = 9
+	SymbolKindEnum        SymbolKind = 10
+	SymbolKindInterface   SymbolKind = 11
+	SymbolKindFunction    SymbolKind = 12
+	SymbolKindStruct      SymbolKind = 23
+)
+
+// DocumentSymbol is a definition and the definitions nested in it, shaped like the
+// LSP textDocument/documentSymbol result.
+type DocumentSymbol struct {
+	Name      string           // Identifier of the definition.
+	Kind      SymbolKind       // LSP kind of the definition.
+	StartLine int              // 0-based line the definition starts on.
+	EndLine   int              // 0-based line the definition ends on.
+	Children  []DocumentSymbol // Definitions nested in this one, in source order.
+}
+
+// lspKinds maps Symbol kinds to LSP symbol kinds.
+var lspKinds = map[string]SymbolKind{
+	"class":       SymbolKindClass,
+	"constructor": SymbolKindConstructor,
+	"enum":        SymbolKindEnum,
+	"func":        SymbolKindFunction,
+	"function":    SymbolKindFunction,
+	"interface":   SymbolKindInterface,
+	"macro":       SymbolKindFunction,
+	"method":      SymbolKindMethod,
+	"module":      SymbolKindModule,
+	"namespace":   SymbolKindNamespace,
+	"record":      SymbolKindClass,
+	"struct":      SymbolKindStruct,
+	"trait":       SymbolKindInterface,
+	"type":        SymbolKindClass,
+	"typedef":     SymbolKindClass,
+	"union":       SymbolKindStruct,
+}
+
+// docSymbol is a DocumentSymbol under construction.
+type docSymbol struct {
+	sym      DocumentSymbol
+	end      uint   // End byte of the definition's node.
+	receiver string // Receiver type name of a Go method.
+	children []*docSymbol
+}
+
+// DocumentSymbols returns the file's definitions as a hierarchy: definitions nested in the
+// source (e.g. methods in a class) become children of the enclosing one, and Go methods are
+// placed under their receiver type when it is declared in the same file.
+func (tc *TreeContext) DocumentSymbols() []DocumentSymbol {
+	var roots []*docSymbol
+	var stack []*docSymbol
+	tc.walkSymbols(func(node *sitter.Node, sym Symbol) {
+		ds := &docSymbol{
+			sym: DocumentSymbol{
+				Name:      sym.Name,
+				Kind:      tc.lspKind(node, sym),
+				StartLine: sym.Line,
+				EndLine:   sym.EndLine,
+			},
+			end: node.EndByte(),
+		}
+		if node.Kind() == "method_declaration" && tc.language == "go" {
+			ds.receiver = tc.receiverType(node)
+		}
+
+		// Symbols arrive in pre-order, so the enclosing definition is the innermost
+		// one on the stack that hasn't ended yet.
+		for len(stack) > 0 && stack[len(stack)-1].end <= node.StartByte() {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, ds)
+		} else {
+			roots = append(roots, ds)
+		}
+		stack = append(stack, ds)
+	})
+
+	roots = nestGoMethods(roots)
+
+	out := make([]DocumentSymbol, 0, len(roots))
+	for _, ds := range roots {
+		out = append(out, ds.build())
+	}
+	return out
+}
+
+// lspKind returns the LSP kind of sym. Go type specs are refined by their underlying type.
+func (tc *TreeContext) lspKind(node *sitter.Node, sym Symbol) SymbolKind {
+	if node.Kind() == "type_spec" {
+		if typ := node.ChildByFieldName("type"); typ != nil {
+			switch typ.Kind() {
+			case "struct_type":
+				return SymbolKindStruct
+			case "interface_type":
+				return SymbolKindInterface
+			}
+		}
+	}
+	return lspKinds[sym.Kind]
+}
+
+// receiverType returns the name of the type a Go method is declared on, without any
+// pointer or type parameters.
+func (tc *TreeContext) receiverType(method *sitter.Node) string {
+	receiver := method.ChildByFieldName("receiver")
+	if receiver == nil {
+		return ""
+	}
+	for _, n := range tc.findAllChildren(receiver) {
+		if n.Kind() == "type_identifier" {
+			return n.Utf8Text(tc.source)
+		}
+	}
+	return ""
+}
+
+// nestGoMethods moves top-level methods under the top-level type they're declared on.
+func nestGoMethods(roots []*docSymbol) []*docSymbol {
+	types := make(map[string]*docSymbol)
+	for _, ds := range roots {
+		if ds.receiver == "" && ds.sym.Kind != SymbolKindFunction {
+			types[ds.sym.Name] = ds
+		}
+	}
+
+	kept := roots[:0]
+	for _, ds := range roots {
+		if owner, ok := types[ds.receiver]; ok && ds.receiver != "" {
+			owner.children = append(owner.children, ds)
+			continue
+		}
+		kept = append(kept, ds)
+	}
+	return kept
+}
+
+// build converts ds and its descendants to a DocumentSymbol.
+func (ds *docSymbol) build() DocumentSymbol {
+	sym := ds.sym
+	for _, child := range ds.children {
+		sym.Children = append(sym.Children, child.build())
+	}
+	return sym
+}
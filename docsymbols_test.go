@@ -0,0 +1,55 @@
+package grepast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocumentSymbols(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		source   string
+		want     []DocumentSymbol
+	}{
+		{
+			name:     "go methods under their type",
+			filename: "main.go",
+			source: "package main\n\nfunc (s *Server) Start() {}\n\ntype Server struct{}\n\n" +
+				"func (s Server) Stop() {}\n\ntype Handler interface {\n\tServe()\n}\n\n" +
+				"func (o *Other) Orphan() {}\n\nfunc main() {}\n",
+			want: []DocumentSymbol{
+				{Name: "Server", Kind: SymbolKindStruct, StartLine: 4, EndLine: 4, Children: []DocumentSymbol{
+					{Name: "Start", Kind: SymbolKindMethod, StartLine: 2, EndLine: 2},
+					{Name: "Stop", Kind: SymbolKindMethod, StartLine: 6, EndLine: 6},
+				}},
+				{Name: "Handler", Kind: SymbolKindInterface, StartLine: 8, EndLine: 10},
+				{Name: "Orphan", Kind: SymbolKindMethod, StartLine: 12, EndLine: 12},
+				{Name: "main", Kind: SymbolKindFunction, StartLine: 14, EndLine: 14},
+			},
+		},
+		{
+			name:     "python nesting by scope",
+			filename: "app.py",
+			source:   "class App:\n    def run(self):\n        def helper():\n            pass\n\n    def stop(self):\n        pass\n\ndef main():\n    pass\n",
+			want: []DocumentSymbol{
+				{Name: "App", Kind: SymbolKindClass, StartLine: 0, EndLine: 6, Children: []DocumentSymbol{
+					{Name: "run", Kind: SymbolKindFunction, StartLine: 1, EndLine: 3, Children: []DocumentSymbol{
+						{Name: "helper", Kind: SymbolKindFunction, StartLine: 2, EndLine: 3},
+					}},
+					{Name: "stop", Kind: SymbolKindFunction, StartLine: 5, EndLine: 6},
+				}},
+				{Name: "main", Kind: SymbolKindFunction, StartLine: 8, EndLine: 9},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext(tt.filename, []byte(tt.source), TreeContextOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tc.DocumentSymbols())
+		})
+	}
+}
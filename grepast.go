@@ -1,101 +1,271 @@
 package grepast
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	sitter "github.com/tree-sitter/go-tree-sitter"
 )
 
+// zeroHeader is the unresolved header of a line where no multi-line node starts.
+var zeroHeader = []int{0, 0}
+
+// utf8BOM is the byte order mark some editors prepend to UTF-8 files.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
 // TreeContext stores context about source code lines, parsing, scopes, and line-of-interest management.
+//
+// Line numbers in the API (Grep results, lines of interest, accessors) are 0-based; only the
+// formatted output shows 1-based numbers. The ...1 helpers such as AddLineOfInterest1 accept
+// the 1-based numbers editors and compilers print.
+//
+// The Grep variants, HighlightMulti and AddLinesOfInterest may be called from several
+// goroutines at once. Everything else (AddContext, the Format variants, Reparse, ...)
+// must not run concurrently with other calls; use Clone to work on one file in parallel.
 type TreeContext struct {
-	filename                 string             // Name of the file being processed.
-	source                   []byte             // Source code content as a byte array.
-	color                    bool               // Whether to use color for highlighted output.
-	verbose                  bool               // Whether to enable verbose output for debugging.
-	lineNumber               bool               // Whether to include line numbers in the output.
-	lastLine                 bool               // Whether to always include the last line in the output.
-	margin                   int                // Number of lines to include as a margin at the top of the output.
-	markLOIs                 bool               // Whether to visually mark lines of interest (LOI).
-	headerMax                int                // Maximum number of header lines to display.
-	loiPad                   int                // Number of lines of padding around lines of interest.
-	showTopOfFileParentScope bool               // Whether to include the parent scope starting from the top of the file.
-	parentContext            bool               // Whether to include parent context in the output.
-	childContext             bool               // Whether to include child context in the output.
-	lines                    []string           // Source code split into individual lines.
-	numLines                 int                // Total number of lines in the source code (including an optional trailing newline adjustment).
-	outputLines              map[int]string     // Map of output lines, optionally with highlights.
-	scopes                   []map[int]struct{} // Tracks scope relationships by line.
-	header                   [][]int            // Each element is a slice representing [startLine, endLine] of headers.
-	nodes                    [][]*sitter.Node   // Tracks parse-tree nodes indexed by their start line.
-	showLines                map[int]struct{}   // Lines to show in the final output.
-	linesOfInterest          map[int]struct{}   // Lines explicitly marked as "lines of interest" (LOI).
-	doneParentScopes         map[int]struct{}   // Tracks parent scopes that have already been processed.
+	filename                 string           // Name of the file being processed.
+	language                 string           // Name of the detected (or overridden) language.
+	source                   []byte           // Source code content as a byte array.
+	color                    bool             // Whether to use color for highlighted output.
+	verbose                  bool             // Whether to enable verbose output for debugging.
+	lineNumber               bool             // Whether to include line numbers in the output.
+	lastLine                 bool             // Whether to always include the last line in the output.
+	margin                   int              // Number of lines to include as a margin at the top of the output.
+	markLOIs                 bool             // Whether to visually mark lines of interest (LOI).
+	headerMax                int              // Maximum number of header lines to display.
+	loiPad                   int              // Number of lines of padding around lines of interest.
+	showTopOfFileParentScope bool             // Whether to include the parent scope starting from the top of the file.
+	parentContext            bool             // Whether to include parent context in the output.
+	childContext             bool             // Whether to include child context in the output.
+	numLines                 int              // One more than the number of strings.Split lines (mirrors Python's len+1); see lastRealLine.
+	outputLines              map[int]string   // Map of output lines, optionally with highlights.
+	scopeEnd                 []int            // Last line of the widest scope starting on each line, or -1.
+	scopeStarts              []int            // Start lines of the scopes covering each line, flattened; see scopesOf.
+	scopeIndex               []int            // Line i's scopes are scopeStarts[scopeIndex[i]:scopeIndex[i+1]].
+	header                   [][]int          // Each element is a slice representing [startLine, endLine] of headers.
+	nodes                    [][]*sitter.Node // Tracks parse-tree nodes indexed by their start line.
+	showLines                map[int]struct{} // Lines to show in the final output.
+	linesOfInterest          map[int]struct{} // Lines explicitly marked as "lines of interest" (LOI).
+	doneParentScopes         map[int]struct{} // Tracks parent scopes that have already been processed.
+	blank                    bool             // Whether the source is empty or whitespace-only.
+	maxOutputTokens          int              // Approximate token budget for FormatWithinBudget (0 = unlimited).
+	caretUnderline           bool             // Whether to print carets under matched spans of lines of interest.
+	scopeClosers             bool             // Whether to show the closing line of each revealed parent scope.
+	leadingComments          bool             // Whether to show comment lines directly above each revealed parent scope.
+	comments                 map[int]int      // Comments that sit on their own lines, keyed by end line, valued by start line.
+	showImports              bool             // Whether to always show the package/import declarations.
+	tree                     *sitter.Tree     // Parse tree, retained until Close.
+	root                     *sitter.Node     // Root node of the parse tree.
+	lineStarts               []int            // Byte offset in source at which each line begins; line slices source with them.
+	maxDepth                 int              // Maximum parse tree depth indexed by walkTree (0 = unlimited).
+	skipComments             bool             // Drop grep matches inside comments.
+	lineNumberFormat         string           // Custom line number format; empty = auto width.
+	marginOnlyWithTopMatch   bool             // Skip the top margin unless a line of interest is inside it.
+	truncationMarker         string           // Marker for headers truncated by headerMax.
+	truncatedHeaders         map[int]struct{} // Last kept line of each truncated header.
+	skipErrorNodes           bool             // Leave ERROR/MISSING nodes out of scopes and headers.
+	mu                       *sync.Mutex      // Guards writes by concurrent Grep and AddLinesOfInterest calls.
+	lastLineOfScope          map[int]int      // Memoized getLastLineOfScope results.
+	sortedShow               []int            // Sorted copy of showLines, cached by AddContext; nil after invalidateShown.
+	matches                  map[int][]Match  // Match spans found by Grep, keyed by line.
+	maxOutputLines           int              // Cap on the lines AddContext selects (0 = unlimited).
+	truncated                bool             // Whether AddContext trimmed context to fit maxOutputLines.
+	dropTinyHunks            bool             // Omit single shown lines surrounded by elided gaps.
+	siblingSignatures        bool             // Whether to show the signatures of declarations next to the one a LOI is in.
+	expandToStatement        bool             // Whether to show the whole statement each line of interest is part of.
+	buildDirectives          bool             // Whether to always show a Go file's leading build constraints and //go: directives.
+	highlightFunc            HighlightFunc    // Custom transform for matched text; nil = red ANSI when color is set.
+	finalLine                bool             // Whether to show the last non-blank line of the file, on its own.
+	noLeadingReset           bool             // Whether to leave out the color reset line at the start of colored output.
+	separator                string           // Gutter glyph between the line number and a line that isn't marked as of interest.
+	padSeparator             bool             // Whether to put a space on either side of the gutter glyph.
+	annotations              bool             // Whether to show decorator and annotation lines directly above each revealed parent scope.
+	unnamedNodes             bool             // Whether to index anonymous nodes (punctuation, keywords) as well as named ones.
+	smallScopeThreshold      int              // Scopes of at most this many lines are revealed whole by child context; 0 means 5.
+	noBlankPickup            bool             // Whether closeSmallGaps leaves out the blank line after a shown line.
+	allowBinary              bool             // Whether Reparse accepts binary content.
+	bom                      bool             // Whether the caller's source began with a UTF-8 BOM, stripped before parsing.
+	parentShown              map[int]struct{} // Lines AddContext revealed as parent context, trimmed last.
+	marginShown              map[int]struct{} // Lines AddContext revealed as the top margin, trimmed before parent context.
+}
+
+// Match is a single pattern match within a source line.
+type Match struct {
+	Line  int // 0-based line number of the match.
+	Start int // Byte offset of the match start within the line.
+	End   int // Byte offset just past the end of the match within the line.
 }
 
+// HighlightFunc transforms the text of a match into its highlighted form, e.g. wrapping it
+// in editor markup.
+type HighlightFunc func(match string) string
+
 // TreeContextOptions specifies various options for initializing TreeContext.
 type TreeContextOptions struct {
-	Color                    bool // Use colored output for matches or highlights.
-	Verbose                  bool // Enable verbose mode for additional debugging or insights.
-	ShowLineNumber           bool // Include line numbers in the output.
-	ShowParentContext        bool // Show the parent scope of lines of interest in the output.
-	ShowChildContext         bool // Show the child scope of lines of interest in the output.
-	ShowLastLine             bool // Always include the last line in the output.
-	MarginPadding            int  // Number of lines to add as a margin at the top of the output.
-	MarkLinesOfInterest      bool // Visually mark lines of interest (LOI) in the output.
-	HeaderMax                int  // Maximum number of header lines to display.
-	ShowTopOfFileParentScope bool // Always include the top-most parent scope from the file's beginning.
-	LinesOfInterestPadding   int  // Number of lines of padding around each line of interest.
+	Color                    bool           // Use colored output for matches or highlights.
+	Verbose                  bool           // Enable verbose mode for additional debugging or insights.
+	ShowLineNumber           bool           // Include line numbers in the output.
+	ShowParentContext        bool           // Show the parent scope of lines of interest in the output.
+	ShowChildContext         bool           // Show the child scope of lines of interest in the output.
+	ShowLastLine             bool           // Always include the last line in the output, together with its parent scopes.
+	MarginPadding            int            // Number of lines to add as a margin at the top of the output.
+	MarkLinesOfInterest      bool           // Visually mark lines of interest (LOI) in the output.
+	HeaderMax                int            // Maximum number of header lines to display.
+	ShowTopOfFileParentScope bool           // Always include the top-most parent scope from the file's beginning, plus its package/namespace line.
+	LinesOfInterestPadding   int            // Number of lines of padding around each line of interest.
+	AllowBinary              bool           // Parse the source even if it looks like binary content.
+	Language                 string         // Language name to use instead of detecting it from the filename (e.g. "go" for a ".txt" file).
+	MaxOutputTokens          int            // Approximate token budget for FormatWithinBudget (0 = unlimited).
+	ShowCaretUnderline       bool           // Print a line of carets under the matched spans of each line of interest.
+	ShowScopeClosers         bool           // Also show the closing line (e.g. "}") of each revealed parent scope.
+	IncludeLeadingComments   bool           // Also show the contiguous comment lines directly above each revealed parent scope.
+	ShowImports              bool           // Always show the file's package/import declarations.
+	MaxDepth                 int            // Maximum parse tree depth indexed for scopes (0 = unlimited).
+	SkipComments             bool           // Discard grep matches that fall inside a comment.
+	LineNumberFormat         string         // fmt format for line numbers, e.g. "%05d" or "%d:" (default: auto-sized %Nd).
+	MarginOnlyWithTopMatch   bool           // Add the MarginPadding top lines only when a line of interest falls within them.
+	HeaderTruncationMarker   string         // Appended to the last shown line of a header cut short by HeaderMax, e.g. " …".
+	HeaderMaxByLanguage      map[string]int // Per-language HeaderMax keyed by language name (e.g. "java"), falling back to HeaderMax.
+	SkipErrorNodes           bool           // Don't index tree-sitter ERROR/MISSING nodes as scopes.
+	MaxOutputLines           int            // Maximum number of lines AddContext selects; extra context is trimmed (0 = unlimited).
+	DropTinyHunks            bool           // Leave out lone context lines that would sit between two ellipses.
+	ShowSiblingSignatures    bool           // Show the signature lines of the declarations beside the one containing each line of interest.
+	ExpandToStatement        bool           // Show every line of the statement a line of interest belongs to (e.g. a call split across lines).
+	ShowBuildDirectives      bool           // Always show a Go file's leading //go:build, // +build and other //go: directive lines.
+	HighlightFunc            HighlightFunc  // Transform applied to matched text by Grep instead of the red ANSI wrapper (used even without Color).
+	AlwaysShowFinalLine      bool           // Always include the last non-blank line, without ShowLastLine's parent-scope expansion.
+	NoLeadingReset           bool           // With Color, don't start the output with a "\033[0m" reset line, e.g. to embed it inline.
+	Separator                string         // Gutter glyph before each line not marked as of interest; "│" if empty.
+	PadSeparator             bool           // Put a space on either side of the gutter glyph, e.g. "  3 │ code".
+	IncludeAnnotations       bool           // Also show the decorator or annotation lines (e.g. Python's @cache) directly above each revealed parent scope.
+	IncludeUnnamedNodes      bool           // Index anonymous nodes such as braces and keywords too, so a closing "}" line has its own node and scope.
+	SmallScopeThreshold      int            // With ShowChildContext, reveal scopes of at most this many lines in full; 0 means 5.
+	NoTrailingBlankPickup    bool           // Don't also show the blank line after each shown line (negated so zero options keep it); one-line gaps are still closed.
+}
+
+// CompactProfile returns options for short snippets: each line of interest with the first
+// header line of its enclosing scopes and line numbers, without child context or margins.
+func CompactProfile() TreeContextOptions {
+	return TreeContextOptions{
+		ShowLineNumber:      true,
+		ShowParentContext:   true,
+		MarkLinesOfInterest: true,
+		HeaderMax:           1,
+	}
+}
+
+// FullProfile returns options for reading a match in depth: full parent headers and their
+// closing lines, child context, the top of the file and a line of padding around each line
+// of interest. Color is left to the caller.
+func FullProfile() TreeContextOptions {
+	return TreeContextOptions{
+		ShowLineNumber:           true,
+		ShowParentContext:        true,
+		ShowChildContext:         true,
+		MarginPadding:            3,
+		MarkLinesOfInterest:      true,
+		HeaderMax:                10,
+		ShowTopOfFileParentScope: true,
+		LinesOfInterestPadding:   1,
+		ShowScopeClosers:         true,
+	}
 }
 
 // NewTreeContext is the Go-equivalent constructor for TreeContext.
 // It initializes the context for analyzing and working with source code.
+// The context keeps and shares source rather than copying it, so source must not be
+// modified while the context is in use.
 func NewTreeContext(filename string, source []byte, options TreeContextOptions) (*TreeContext, error) {
-	// Get the language from the filename.
+
+	// Get the language from the filename (or the Language override).
+	lang, name, err := resolveLanguage(filename, source, options)
+	if err != nil {
+		return nil, err // Return an error if the file type cannot be recognized; wraps the sentinel errors.
+	}
+
+	// Initialize Tree-sitter parser for parsing source code into an abstract syntax tree (AST).
+	parser := sitter.NewParser()
+	defer parser.Close() // The tree outlives the parser.
+	if err := parser.SetLanguage(lang); err != nil {
+		// The grammar was generated with an ABI the binding cannot load.
+		return nil, fmt.Errorf("%w (%s): %v", ErrorParseFailed, filename, err)
+	}
+
+	return newTreeContext(filename, name, source, parser, options)
+}
+
+// NewTreeContextFromLines is like NewTreeContext for a source that is already split into
+// lines without their "\n" terminators, as editors keep it. The lines are joined once for
+// the parser and not kept: the context's lines are views into the joined source.
+func NewTreeContextFromLines(filename string, lines []string, options TreeContextOptions) (*TreeContext, error) {
+	if len(lines) == 0 {
+		return NewTreeContext(filename, nil, options)
+	}
+	return NewTreeContext(filename, []byte(strings.Join(lines, "\n")), options)
+}
+
+// resolveLanguage determines the tree-sitter language for filename, honoring options.Language.
+// When the name is unrecognized and there is no override, the language is
+// detected from the content.
+func resolveLanguage(filename string, source []byte, options TreeContextOptions) (*sitter.Language, string, error) {
 	// Determines the programming language to use for parsing based on the file extension.
-	lang, _, err := GetLanguageFromFileName(filename)
+	lang, name, err := GetLanguageFromFileName(filename)
+	if options.Language != "" {
+		// An explicit language overrides extension-based detection.
+		name = options.Language
+		lang, err = GetLanguage(options.Language)
+		if err != nil {
+			err = fmt.Errorf("%w (%s)", err, filename)
+		}
+	}
+	if options.Language == "" && errors.Is(err, ErrorUnrecognizedFiletype) {
+		// As a last resort, look at the file's first lines. A recognized extension without
+		// a grammar (.c, .json) stays unsupported rather than being guessed at.
+		if detected := detectLanguage(source); detected != "" {
+			if detectedLang, detectErr := GetLanguage(detected); detectErr == nil {
+				return detectedLang, detected, nil
+			}
+		}
+	}
 	if err != nil {
-		return nil, err // Return an error if the file type cannot be recognized.
+		return nil, "", err
 	}
 
 	// Return an error if the language is not supported.
 	if lang == nil {
-		return nil, fmt.Errorf("unrecognized or unsupported file type (%s)", filename)
+		return nil, "", fmt.Errorf("%w (%s)", ErrorUnsupportedLanguage, filename)
 	}
 
-	// Initialize Tree-sitter parser for parsing source code into an abstract syntax tree (AST).
-	parser := sitter.NewParser()
-	parser.SetLanguage(lang) // Set the parser's language to match the file type.
-
-	// Parse the source code into a syntax tree.
-	tree := parser.Parse(source, nil)
-
-	// Retrieve the root node of the syntax tree for traversal.
-	rootNode := tree.RootNode()
+	return lang, name, nil
+}
 
-	// Split the source code into lines for easier processing.
-	lines := strings.Split(string(source), "\n")
-	numLines := len(lines)
-	if len(source) > 0 && source[len(source)-1] == '\n' {
-		// Adjust for a trailing newline, aligning with Python's len+1 logic.
-		numLines += 0
+// newTreeContext parses source with parser, whose language must already be set,
+// and builds the TreeContext from the resulting tree.
+func newTreeContext(filename, language string, source []byte, parser *sitter.Parser, options TreeContextOptions) (*TreeContext, error) {
+	source, bom, err := prepareSource(filename, source, options.AllowBinary)
+	if err != nil {
+		return nil, err
 	}
 
-	// Initialize scopes, headers, and nodes for tracking relationships and parsing metadata.
-	scopes := make([]map[int]struct{}, numLines+1) // +1 to mimic Python’s len+1 logic.
-	header := make([][]int, numLines+1)            // Track start and end lines for each header.
-	nodes := make([][]*sitter.Node, numLines+1)    // Track AST nodes by their starting line.
-	for i := 0; i <= numLines; i++ {
-		scopes[i] = make(map[int]struct{})
-		header[i] = []int{0, 0}
-		nodes[i] = []*sitter.Node{}
+	// Parse the source code into a syntax tree and retrieve its root node for traversal.
+	tree, rootNode, err := parseSource(parser, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s)", err, filename)
 	}
 
 	// Create and populate the TreeContext object with initialized values.
 	tc := &TreeContext{
 		filename:                 filename,
-		source:                   source,
+		language:                 language,
 		color:                    options.Color,
 		verbose:                  options.Verbose,
 		lineNumber:               options.ShowLineNumber,
@@ -104,28 +274,276 @@ func NewTreeContext(filename string, source []byte, options TreeContextOptions)
 		lastLine:                 options.ShowLastLine,
 		margin:                   options.MarginPadding,
 		markLOIs:                 options.MarkLinesOfInterest,
-		headerMax:                options.HeaderMax,
+		headerMax:                headerMaxFor(language, options),
 		loiPad:                   options.LinesOfInterestPadding,
 		showTopOfFileParentScope: options.ShowTopOfFileParentScope,
-		lines:                    lines,
-		numLines:                 numLines + 1, // Account for potential trailing newlines.
-		outputLines:              make(map[int]string),
-		scopes:                   scopes,
-		header:                   header,
-		nodes:                    nodes,
-		showLines:                make(map[int]struct{}),
-		linesOfInterest:          make(map[int]struct{}),
-		doneParentScopes:         make(map[int]struct{}),
+		maxOutputTokens:          options.MaxOutputTokens,
+		caretUnderline:           options.ShowCaretUnderline,
+		scopeClosers:             options.ShowScopeClosers,
+		leadingComments:          options.IncludeLeadingComments,
+		showImports:              options.ShowImports,
+		maxDepth:                 options.MaxDepth,
+		skipComments:             options.SkipComments,
+		lineNumberFormat:         options.LineNumberFormat,
+		marginOnlyWithTopMatch:   options.MarginOnlyWithTopMatch,
+		truncationMarker:         options.HeaderTruncationMarker,
+		skipErrorNodes:           options.SkipErrorNodes,
+		maxOutputLines:           options.MaxOutputLines,
+		dropTinyHunks:            options.DropTinyHunks,
+		siblingSignatures:        options.ShowSiblingSignatures,
+		expandToStatement:        options.ExpandToStatement,
+		buildDirectives:          options.ShowBuildDirectives,
+		highlightFunc:            options.HighlightFunc,
+		finalLine:                options.AlwaysShowFinalLine,
+		noLeadingReset:           options.NoLeadingReset,
+		separator:                options.Separator,
+		padSeparator:             options.PadSeparator,
+		annotations:              options.IncludeAnnotations,
+		unnamedNodes:             options.IncludeUnnamedNodes,
+		smallScopeThreshold:      options.SmallScopeThreshold,
+		noBlankPickup:            options.NoTrailingBlankPickup,
+		allowBinary:              options.AllowBinary,
+		bom:                      bom,
+		mu:                       new(sync.Mutex),
+	}
+	tc.index(source, tree, rootNode)
+
+	// Return the initialized TreeContext object.
+	return tc, nil
+}
+
+// index (re)builds everything derived from source and its parse tree: lines, scopes,
+// headers and nodes. Lines of interest, matches and selected context start out empty.
+func (tc *TreeContext) index(source []byte, tree *sitter.Tree, rootNode *sitter.Node) {
+	// Split the source code into lines for easier processing. A trailing newline leaves an
+	// empty last line; it is indexed like any line, but lastRealLine excludes it from
+	// output so files with and without a final newline render the same. Lines are kept as
+	// offsets into source rather than copies, so a large file isn't held twice.
+	tc.source = source
+	tc.tree = tree
+	tc.root = rootNode
+	tc.lineStarts = lineStartOffsets(source)
+	numLines := len(tc.lineStarts)
+	tc.numLines = numLines + 1 // Account for potential trailing newlines.
+	tc.blank = len(bytes.TrimSpace(source)) == 0
+
+	// Initialize scopes, headers, and nodes for tracking relationships and parsing metadata.
+	// Entries are allocated on first write by walkTree; nil reads as empty (or the zero header).
+	// Scopes are recorded as one interval per start line and flattened by indexScopes.
+	tc.scopeEnd = make([]int, numLines+1) // +1 to mimic Python’s len+1 logic.
+	for i := range tc.scopeEnd {
+		tc.scopeEnd[i] = -1
 	}
+	tc.header = make([][]int, numLines+1)         // Track start and end lines for each header.
+	tc.nodes = make([][]*sitter.Node, numLines+1) // Track AST nodes by their starting line.
+	tc.comments = make(map[int]int)
+	tc.lastLineOfScope = nil
+	tc.truncatedHeaders = nil
+
+	tc.outputLines = make(map[int]string)
+	tc.showLines = make(map[int]struct{})
+	tc.linesOfInterest = make(map[int]struct{})
+	tc.doneParentScopes = make(map[int]struct{})
+	tc.matches = make(map[int][]Match)
+	tc.invalidateShown()
+	tc.truncated = false
+	tc.parentShown = nil
+	tc.marginShown = nil
 
 	// Walk through the parse tree to populate headers, scopes, and nodes.
 	tc.walkTree(rootNode, 0)
+	tc.indexScopes()
 
 	// Perform additional processing on scopes and headers after tree traversal.
 	tc.postWalkProcessing()
+}
 
-	// Return the initialized TreeContext object.
-	return tc, nil
+// prepareSource strips a leading UTF-8 BOM from source, so it doesn't end up in line 0 or
+// shift tree-sitter offsets, and reports whether there was one. Binary content is refused
+// unless allowBinary is set; tree-sitter would happily parse garbage.
+func prepareSource(filename string, source []byte, allowBinary bool) ([]byte, bool, error) {
+	bom := bytes.HasPrefix(source, utf8BOM)
+	if bom {
+		source = source[len(utf8BOM):]
+	}
+	if !allowBinary && detectBinary(source) {
+		return nil, false, fmt.Errorf("%w (%s)", ErrorBinaryFile, filename)
+	}
+	return source, bom, nil
+}
+
+// Reparse updates the context after the source was edited, reusing the old parse tree so
+// tree-sitter only re-parses the changed region. edit describes the change in the byte and
+// point coordinates of the old and new source, as for sitter.Tree.Edit. Lines, scopes,
+// headers and nodes are rebuilt; lines of interest, matches and context are cleared.
+// newSource is prepared like NewTreeContext's source. On error the context is unchanged.
+func (tc *TreeContext) Reparse(newSource []byte, edit sitter.InputEdit) error {
+	if tc.tree == nil {
+		return fmt.Errorf("%w (%s): context is closed", ErrorParseFailed, tc.filename)
+	}
+	newSource, bom, err := prepareSource(tc.filename, newSource, tc.allowBinary)
+	if err != nil {
+		return err
+	}
+
+	parser := sitter.NewParser()
+	defer parser.Close()
+	if err := parser.SetLanguage(tc.tree.Language()); err != nil {
+		return fmt.Errorf("%w (%s): %v", ErrorParseFailed, tc.filename, err)
+	}
+
+	// edit a copy, so a failed parse leaves tc.tree matching tc.source
+	old := tc.tree.Clone()
+	defer old.Close()
+	edit = stripEditBOM(edit, tc.bom, bom)
+	old.Edit(&edit)
+	tree, rootNode, err := parseSource(parser, newSource, old)
+	if err != nil {
+		return fmt.Errorf("%w (%s)", err, tc.filename)
+	}
+	tc.tree.Close()
+
+	tc.bom = bom
+	tc.index(newSource, tree, rootNode)
+	return nil
+}
+
+// stripEditBOM moves edit's coordinates, given in the caller's sources, onto the sources
+// the trees were parsed from: without the BOM the old (oldBOM) or new (newBOM) source had.
+func stripEditBOM(edit sitter.InputEdit, oldBOM, newBOM bool) sitter.InputEdit {
+	shift := func(offset uint, point sitter.Point, bom bool) (uint, sitter.Point) {
+		if !bom {
+			return offset, point
+		}
+		n := uint(len(utf8BOM))
+		if point.Row == 0 {
+			point.Column -= min(point.Column, n)
+		}
+		return offset - min(offset, n), point
+	}
+	edit.StartByte, edit.StartPosition = shift(edit.StartByte, edit.StartPosition, oldBOM && newBOM)
+	edit.OldEndByte, edit.OldEndPosition = shift(edit.OldEndByte, edit.OldEndPosition, oldBOM)
+	edit.NewEndByte, edit.NewEndPosition = shift(edit.NewEndByte, edit.NewEndPosition, newBOM)
+	return edit
+}
+
+// lock acquires the mutex guarding concurrent grep writes and returns its unlock function.
+func (tc *TreeContext) lock() func() {
+	if tc.mu == nil {
+		// not built by NewTreeContext; nothing to guard against
+		return func() {}
+	}
+	tc.mu.Lock()
+	return tc.mu.Unlock
+}
+
+// Clone returns a copy of tc with its own selection state (lines of interest, shown lines,
+// matches and highlights), so several searches over one parsed file can run independently,
+// e.g. one clone per goroutine. The parse-derived data (lines, scopes, headers, nodes and the
+// tree) is shared and must not be modified. The clone doesn't own the tree: closing it doesn't
+// free the tree, and tc must not be closed or reparsed while clones are in use.
+func (tc *TreeContext) Clone() *TreeContext {
+	clone := *tc
+	clone.tree = nil
+	clone.mu = new(sync.Mutex)
+	clone.outputLines = make(map[int]string, len(tc.outputLines))
+	for line, text := range tc.outputLines {
+		clone.outputLines[line] = text
+	}
+	clone.showLines = copyLineSet(tc.showLines)
+	clone.linesOfInterest = copyLineSet(tc.linesOfInterest)
+	clone.doneParentScopes = copyLineSet(tc.doneParentScopes)
+	clone.matches = make(map[int][]Match, len(tc.matches))
+	for line, spans := range tc.matches {
+		clone.matches[line] = append([]Match(nil), spans...)
+	}
+	clone.invalidateShown()
+	// the memo is filled lazily, so it can't be shared between goroutines
+	clone.lastLineOfScope = nil
+	return &clone
+}
+
+// Close releases the parse tree. The TreeContext and any nodes obtained from it
+// must not be used afterwards.
+func (tc *TreeContext) Close() {
+	if tc.tree != nil {
+		tc.tree.Close()
+		tc.tree = nil
+	}
+	tc.root = nil
+}
+
+// RootNode returns the root node of the parse tree, or nil after Close.
+func (tc *TreeContext) RootNode() *sitter.Node {
+	return tc.root
+}
+
+// HasParseErrors reports whether the source had syntax errors, i.e. the tree contains
+// ERROR or MISSING nodes.
+func (tc *TreeContext) HasParseErrors() bool {
+	return tc.root != nil && tc.root.HasError()
+}
+
+// SExpression returns the parse tree as an S-expression, useful when debugging scope detection.
+func (tc *TreeContext) SExpression() string {
+	if tc.root == nil {
+		return ""
+	}
+	return tc.root.ToSexp()
+}
+
+// Walk does a depth-first walk over the named nodes of the parse tree, starting at the root
+// with depth 0. Children of a node are skipped when fn returns false for it.
+func (tc *TreeContext) Walk(fn func(node *sitter.Node, depth int) bool) {
+	if tc.root == nil {
+		return
+	}
+	walkNamed(tc.root, 0, fn)
+}
+
+// walkNamed visits node and, if fn allows it, its named descendants.
+func walkNamed(node *sitter.Node, depth int, fn func(node *sitter.Node, depth int) bool) {
+	if !fn(node, depth) {
+		return
+	}
+	for i := uint(0); i < node.NamedChildCount(); i++ {
+		if child := node.NamedChild(i); child != nil {
+			walkNamed(child, depth+1, fn)
+		}
+	}
+}
+
+// NodeAt returns the deepest named node covering the given 0-based line and byte column,
+// or nil if the position is outside the source.
+func (tc *TreeContext) NodeAt(line, col int) *sitter.Node {
+	if tc.root == nil || line < 0 || line >= len(tc.lineStarts) || col < 0 || col >= len(tc.line(line)) {
+		return nil
+	}
+	offset := uint(tc.lineStarts[line] + col)
+	return tc.root.NamedDescendantForByteRange(offset, offset)
+}
+
+// headerMaxFor returns the HeaderMax to use for files in lang.
+func headerMaxFor(lang string, options TreeContextOptions) int {
+	if n, ok := options.HeaderMaxByLanguage[lang]; ok {
+		return n
+	}
+	return options.HeaderMax
+}
+
+// parseSource parses source with parser and returns the tree and its root node. A non-nil
+// old tree, already edited to match source, is reused for incremental parsing.
+// tree-sitter returns a nil tree when no usable language is set, so guard against it.
+func parseSource(parser *sitter.Parser, source []byte, old *sitter.Tree) (*sitter.Tree, *sitter.Node, error) {
+	tree := parser.Parse(source, old)
+	if tree == nil {
+		return nil, nil, ErrorParseFailed
+	}
+	rootNode := tree.RootNode()
+	if rootNode == nil {
+		return nil, nil, ErrorParseFailed
+	}
+	return tree, rootNode, nil
 }
 
 // postWalkProcessing sets header ranges and optionally prints scopes.
@@ -136,18 +554,27 @@ func (tc *TreeContext) postWalkProcessing() {
 	if tc.verbose {
 		// find the maximum width for printing scopes
 		for i := 0; i < tc.numLines-1; i++ {
-			scopeStr := fmt.Sprintf("%v", mapKeysSorted(tc.scopes[i]))
+			scopeStr := fmt.Sprintf("%v", tc.scopesOf(i))
 			if len(scopeStr) > scopeWidth {
 				scopeWidth = len(scopeStr)
 			}
 		}
 	}
 
+	// one backing array for every resolved [start, end) header
+	spans := make([]int, 2*tc.numLines)
+
 	for i := 0; i < tc.numLines; i++ {
 		headerSlice := tc.header[i]
+		if headerSlice == nil {
+			// no multi-line node starts here
+			headerSlice = zeroHeader
+		}
+		resolved := spans[2*i : 2*i+2 : 2*i+2]
 		if len(headerSlice) < 2 {
 			// default
-			tc.header[i] = []int{i, i + 1}
+			resolved[0], resolved[1] = i, i+1
+			tc.header[i] = resolved
 		} else {
 			size := headerSlice[0]
 			headStart := headerSlice[1]
@@ -157,60 +584,646 @@ func (tc *TreeContext) postWalkProcessing() {
 			}
 			if size > tc.headerMax {
 				headEnd = headStart + tc.headerMax
+				if tc.truncationMarker != "" && headEnd > headStart {
+					if tc.truncatedHeaders == nil {
+						tc.truncatedHeaders = make(map[int]struct{})
+					}
+					tc.truncatedHeaders[headEnd-1] = struct{}{}
+				}
 			}
-			tc.header[i] = []int{headStart, headEnd}
+			resolved[0], resolved[1] = headStart, headEnd
+			tc.header[i] = resolved
 		}
 
 		if tc.verbose && i < tc.numLines-1 {
-			scopeStr := fmt.Sprintf("%v", mapKeysSorted(tc.scopes[i]))
-			if i < len(tc.lines) {
-				lineStr := tc.lines[i]
-				fmt.Printf("%-*s %3d %s\n", scopeWidth, scopeStr, i, lineStr)
+			scopeStr := fmt.Sprintf("%v", tc.scopesOf(i))
+			if i < len(tc.lineStarts) {
+				fmt.Printf("%-*s %3d %s\n", scopeWidth, scopeStr, i, tc.line(i))
 			}
 		}
 	}
 }
 
 // Grep finds lines matching a pattern and highlights them.
+// It panics if pat is not a valid regular expression; use GrepErr to handle that case.
+//
+// Patterns are matched against one line at a time, without its line ending ("\n" or "\r\n"),
+// so ^ and $ (and \A and \z) anchor at the start and end of each line, and a match can't
+// span lines. A leading (?m) flag is accepted and changes nothing.
 func (tc *TreeContext) Grep(pat string, ignoreCase bool) map[int]struct{} {
+	found, err := tc.GrepErr(pat, ignoreCase)
+	if err != nil {
+		panic(err)
+	}
+	return found
+}
+
+// GrepErr is like Grep but returns an error if pat is not a valid regular expression.
+func (tc *TreeContext) GrepErr(pat string, ignoreCase bool) (map[int]struct{}, error) {
+	re, err := compilePattern(pat, ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	return tc.grepRegexp(re), nil
+}
+
+// GrepFlags is like GrepErr but takes Go regexp flags instead of ignoreCase: any of i (case
+// insensitive), m (multi-line), s (. matches \n) and U (ungreedy), e.g. "iU". It returns an
+// error wrapping ErrorInvalidFlags for any other flag, or if pat is not a valid regular expression.
+func (tc *TreeContext) GrepFlags(pat string, flags string) (map[int]struct{}, error) {
+	for _, r := range flags {
+		if !strings.ContainsRune("imsU", r) {
+			return nil, fmt.Errorf("%w %q: unknown flag %q", ErrorInvalidFlags, flags, r)
+		}
+	}
+	if flags != "" {
+		pat = "(?" + flags + ")" + pat
+	}
+	return tc.GrepErr(pat, false)
+}
+
+// GrepChain greps for pat and adds the matching lines as lines of interest, returning tc so
+// a whole search reads as one expression:
+//
+//	out := tc.GrepChain("needle", false).WithContext().Format()
+//
+// Like Grep, it panics if pat is not a valid regular expression.
+func (tc *TreeContext) GrepChain(pat string, ignoreCase bool) *TreeContext {
+	tc.AddLinesOfInterest(tc.Grep(pat, ignoreCase))
+	return tc
+}
+
+// WithContext runs AddContext and returns tc, for chaining after GrepChain.
+func (tc *TreeContext) WithContext() *TreeContext {
+	tc.AddContext()
+	return tc
+}
+
+// GrepFormat returns the formatted context snippet for pattern in source: it builds the
+// TreeContext, greps, adds the matches as lines of interest, adds context and formats, the
+// whole pipeline in one call. It returns an error if the file can't be parsed or pattern is
+// not a valid regular expression, and "" if nothing matches.
+func GrepFormat(filename string, source []byte, pattern string, opts TreeContextOptions) (string, error) {
+	tc, err := NewTreeContext(filename, source, opts)
+	if err != nil {
+		return "", err
+	}
+	defer tc.Close()
+
+	found, err := tc.GrepErr(pattern, false)
+	if err != nil {
+		return "", err
+	}
+	tc.AddLinesOfInterest(found)
+	tc.AddContext()
+	return tc.Format(), nil
+}
+
+// GrepInStrings is like Grep but only keeps matches inside a string literal or a comment,
+// e.g. to audit user-facing text. It returns an error if pat is not a valid regular expression.
+func (tc *TreeContext) GrepInStrings(pat string, ignoreCase bool) (map[int]struct{}, error) {
+	re, err := compilePattern(pat, ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	strs, comments := stringKinds[tc.language], commentKindsFor(tc.language)
+	return tc.grepRegexpFunc(re, 0, func(line, col int) bool {
+		return tc.inKinds(line, col, strs) || tc.inKinds(line, col, comments)
+	}), nil
+}
+
+// GrepCapture is like Grep, but records and highlights only the span of the named capture
+// group in each match (e.g. just the name in `func\s+(?P<name>\w+)`); the whole matching
+// line is still returned. It returns an error if pat doesn't compile or has no such group.
+func (tc *TreeContext) GrepCapture(pat, group string, ignoreCase bool) (map[int]struct{}, error) {
+	re, err := compilePattern(pat, ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	idx := re.SubexpIndex(group)
+	if idx < 0 {
+		return nil, fmt.Errorf("no capture group %q in pattern %q", group, pat)
+	}
+	return tc.grepRegexpFunc(re, idx, nil), nil
+}
+
+// GrepInKinds is like Grep but only searches the text of nodes whose kind is one of kinds
+// (e.g. "identifier" or "interpreted_string_literal"), implicitly marking every line of a
+// node whose text matches. Matches within a single line are recorded and highlighted as
+// Grep's are. It returns an error if pat is not a valid regular expression.
+func (tc *TreeContext) GrepInKinds(pat string, kinds []string, ignoreCase bool) (map[int]struct{}, error) {
+	re, err := compilePattern(pat, ignoreCase)
+	if err != nil {
+		return nil, err
+	}
 	found := make(map[int]struct{})
-	if ignoreCase {
-		// Go's regex doesn't have "IGNORECASE" as a flag (like Python),
-		// you compile different patterns or use (?i).
-		pat = "(?i)" + pat
+	if tc.blank {
+		return found, nil
 	}
-	re := regexp.MustCompile(pat)
+	want := kindSet(kinds)
 
-	for i, line := range tc.lines {
-		if re.FindStringIndex(line) != nil {
-			// highlight
-			if tc.color {
-				highlighted := re.ReplaceAllStringFunc(line, func(m string) string {
-					return fmt.Sprintf("\033[1;31m%s\033[0m", m)
-				})
-				tc.outputLines[i] = highlighted
+	spans := make(map[int][]Match)
+	tc.Walk(func(node *sitter.Node, depth int) bool {
+		if _, ok := want[node.Kind()]; !ok {
+			return true
+		}
+		locs := re.FindAllStringIndex(node.Utf8Text(tc.source), -1)
+		if locs == nil {
+			return true
+		}
+		for ln := int(node.StartPosition().Row); ln <= int(node.EndPosition().Row); ln++ {
+			found[ln] = struct{}{}
+		}
+		start := int(node.StartByte())
+		for _, loc := range locs {
+			line, col := tc.lineCol(start + loc[0])
+			endLine, endCol := tc.lineCol(start + loc[1])
+			if line == endLine && endCol > col {
+				spans[line] = append(spans[line], Match{Line: line, Start: col, End: endCol})
 			}
-			found[i] = struct{}{}
 		}
+		return true
+	})
+
+	for i, lineSpans := range spans {
+		tc.recordSpans(i, dedupeSpans(lineSpans))
+	}
+	return found, nil
+}
+
+// GrepNodeText finds the nodes of the given kinds (e.g. "function_declaration") whose whole,
+// possibly multi-line text matches pat, and returns their start lines, so a match anywhere in
+// a declaration is attributed to its first line. Unlike Grep, a match can span lines.
+// Nothing is highlighted. It returns an error if pat is not a valid regular expression.
+func (tc *TreeContext) GrepNodeText(pat string, kinds []string, ignoreCase bool) (map[int]struct{}, error) {
+	re, err := compilePattern(pat, ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[int]struct{})
+	if tc.blank {
+		return found, nil
+	}
+	want := kindSet(kinds)
+
+	tc.Walk(func(node *sitter.Node, depth int) bool {
+		if _, ok := want[node.Kind()]; ok && re.MatchString(node.Utf8Text(tc.source)) {
+			found[int(node.StartPosition().Row)] = struct{}{}
+		}
+		return true
+	})
+	return found, nil
+}
+
+// kindSet returns kinds as a set.
+func kindSet(kinds []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(kinds))
+	for _, kind := range kinds {
+		set[kind] = struct{}{}
+	}
+	return set
+}
+
+// lineCol returns the 0-based line and byte column of a byte offset into the source.
+func (tc *TreeContext) lineCol(offset int) (line, col int) {
+	line = sort.Search(len(tc.lineStarts), func(k int) bool { return tc.lineStarts[k] > offset }) - 1
+	if line < 0 {
+		return 0, offset
+	}
+	return line, offset - tc.lineStarts[line]
+}
+
+// dedupeSpans sorts spans by start and drops any overlapping an earlier one, as nested nodes
+// of the same kind can report the same match twice.
+func dedupeSpans(spans []Match) []Match {
+	sort.Slice(spans, func(a, b int) bool { return spans[a].Start < spans[b].Start })
+	out := spans[:0]
+	for _, m := range spans {
+		if len(out) > 0 && m.Start < out[len(out)-1].End {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// grepRegexp finds lines matching re, records their match spans and highlights them.
+func (tc *TreeContext) grepRegexp(re *regexp.Regexp) map[int]struct{} {
+	return tc.grepRegexpFunc(re, 0, nil)
+}
+
+// grepRegexpFunc is grepRegexp, recording the span of capture group (0 = whole match) and
+// dropping matches for which keep (if non-nil) reports false given the match's line and
+// starting byte column.
+func (tc *TreeContext) grepRegexpFunc(re *regexp.Regexp, group int, keep func(line, col int) bool) map[int]struct{} {
+	found := make(map[int]struct{})
+	if tc.blank {
+		// Nothing to match in an empty or whitespace-only file.
+		return found
+	}
+
+	for i := range tc.lineStarts {
+		line := tc.line(i)
+		// a CRLF file leaves "\r" at the end of each line; $ should still match before it
+		text := bytes.TrimSuffix(line, []byte("\r"))
+		var locs [][]int
+		if group == 0 {
+			locs = re.FindAllIndex(text, -1)
+		} else {
+			locs = re.FindAllSubmatchIndex(text, -1)
+		}
+		if locs == nil {
+			continue
+		}
+
+		// remember the match spans for formatters that need column data
+		kept := 0
+		spans := make([]Match, 0, len(locs))
+		for _, loc := range locs {
+			if tc.skipComments && tc.inKinds(i, loc[0], commentKindsFor(tc.language)) {
+				continue
+			}
+			if keep != nil && !keep(i, loc[0]) {
+				continue
+			}
+			kept++
+			if start, end := loc[2*group], loc[2*group+1]; start >= 0 {
+				// an optional group may not take part in the match
+				spans = append(spans, Match{Line: i, Start: start, End: end})
+			}
+		}
+		if kept == 0 {
+			continue
+		}
+		tc.recordSpans(i, spans)
+		found[i] = struct{}{}
 	}
 	return found
 }
 
-// AddLinesOfInterest adds lines of interest.
+// recordSpans remembers the match spans of line i and highlights them in outputLines.
+func (tc *TreeContext) recordSpans(i int, spans []Match) {
+	defer tc.lock()()
+	if len(spans) > 0 {
+		tc.matches[i] = spans
+	}
+
+	// highlight
+	line := string(tc.line(i))
+	if tc.highlightFunc != nil {
+		tc.outputLines[i] = highlightSpansFunc(line, spans, tc.highlightFunc)
+	} else if tc.color {
+		tc.outputLines[i] = highlightSpans(line, spans)
+	}
+}
+
+// HighlightMulti colors the matches of each pattern in outputLines, giving patterns[i] the
+// SGR color colors[i % len(colors)] (e.g. "1;31"). Lines are rebuilt from the original text,
+// so highlights never nest; where matches overlap, the earlier pattern wins. It returns an
+// error if a pattern doesn't compile or no colors are given. Lines of interest are unchanged.
+func (tc *TreeContext) HighlightMulti(patterns []string, colors []string, ignoreCase bool) error {
+	if len(colors) == 0 {
+		return fmt.Errorf("no highlight colors given")
+	}
+	res := make([]*regexp.Regexp, len(patterns))
+	for p, pat := range patterns {
+		re, err := compilePattern(pat, ignoreCase)
+		if err != nil {
+			return err
+		}
+		res[p] = re
+	}
+
+	for i := range tc.lineStarts {
+		line := tc.line(i)
+		// owner[b] is 1 + the index of the pattern coloring byte b, or 0
+		var owner []int
+		for p, re := range res {
+			for _, loc := range re.FindAllIndex(line, -1) {
+				if owner == nil {
+					owner = make([]int, len(line))
+				}
+				for b := loc[0]; b < loc[1]; b++ {
+					if owner[b] == 0 {
+						owner[b] = p + 1
+					}
+				}
+			}
+		}
+		if owner == nil {
+			continue
+		}
+
+		var sb strings.Builder
+		for start := 0; start < len(line); {
+			end := start + 1
+			for end < len(line) && owner[end] == owner[start] {
+				end++
+			}
+			if p := owner[start]; p > 0 {
+				sb.WriteString("\033[" + colors[(p-1)%len(colors)] + "m" + string(line[start:end]) + "\033[0m")
+			} else {
+				sb.Write(line[start:end])
+			}
+			start = end
+		}
+		unlock := tc.lock()
+		tc.outputLines[i] = sb.String()
+		unlock()
+	}
+	return nil
+}
+
+// inKinds reports whether the node at line and byte column col, or one of its ancestors,
+// has one of the given kinds.
+func (tc *TreeContext) inKinds(line, col int, kinds map[string]struct{}) bool {
+	for node := tc.NodeAt(line, col); node != nil; node = node.Parent() {
+		if _, ok := kinds[node.Kind()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// highlightSpans wraps each span of line in the match color.
+func highlightSpans(line string, spans []Match) string {
+	return highlightSpansFunc(line, spans, func(match string) string {
+		return "\033[1;31m" + match + "\033[0m"
+	})
+}
+
+// highlightSpansFunc replaces each span of line with wrap applied to its text.
+func highlightSpansFunc(line string, spans []Match, wrap HighlightFunc) string {
+	var sb strings.Builder
+	prev := 0
+	for _, m := range spans {
+		sb.WriteString(line[prev:m.Start])
+		sb.WriteString(wrap(line[m.Start:m.End]))
+		prev = m.End
+	}
+	sb.WriteString(line[prev:])
+	return sb.String()
+}
+
+// AddLinesOfInterest adds 0-based lines of interest.
 func (tc *TreeContext) AddLinesOfInterest(lineNums map[int]struct{}) {
+	defer tc.lock()()
 	for ln := range lineNums {
 		tc.linesOfInterest[ln] = struct{}{}
 	}
 }
 
+// AddLineOfInterest adds the 0-based line as a line of interest.
+func (tc *TreeContext) AddLineOfInterest(line int) {
+	defer tc.lock()()
+	tc.linesOfInterest[line] = struct{}{}
+}
+
+// AddLineOfInterest1 adds the 1-based line n (as shown in Format output) as a line of interest.
+func (tc *TreeContext) AddLineOfInterest1(n int) {
+	tc.AddLineOfInterest(n - 1)
+}
+
+// MergeSelection adds other's lines of interest, shown lines, match spans and highlighting to
+// tc, so one Format renders both selections, e.g. of two separate greps. Where both have
+// match spans on a line, they are combined and the line is highlighted again; otherwise tc's
+// highlighting wins. It returns an error if other wraps a different file or line count.
+func (tc *TreeContext) MergeSelection(other *TreeContext) error {
+	if other.filename != tc.filename || other.NumLines() != tc.NumLines() {
+		return fmt.Errorf("can't merge selection of %s (%d lines) into %s (%d lines)",
+			other.filename, other.NumLines(), tc.filename, tc.NumLines())
+	}
+
+	unlock := tc.lock()
+	for ln := range other.linesOfInterest {
+		tc.linesOfInterest[ln] = struct{}{}
+	}
+	for ln := range other.showLines {
+		tc.showLines[ln] = struct{}{}
+	}
+	tc.invalidateShown()
+	for ln, hl := range other.outputLines {
+		if _, ok := tc.outputLines[ln]; !ok {
+			tc.outputLines[ln] = hl
+		}
+	}
+	var both []int
+	for ln, spans := range other.matches {
+		if len(spans) == 0 {
+			continue
+		}
+		if len(tc.matches[ln]) == 0 {
+			tc.matches[ln] = append([]Match(nil), spans...)
+			continue
+		}
+		both = append(both, ln)
+	}
+	unlock()
+
+	for _, ln := range both {
+		spans := append(tc.Matches(ln), other.matches[ln]...)
+		tc.recordSpans(ln, dedupeSpans(spans))
+	}
+	return nil
+}
+
+// Lines returns the source split into lines, indexed by 0-based line number, without line
+// terminators. A trailing newline doesn't add an empty final line. The slice is a copy.
+func (tc *TreeContext) Lines() []string {
+	if tc.NumLines() == 0 {
+		return nil
+	}
+	lines := make([]string, tc.NumLines())
+	for i := range lines {
+		lines[i] = string(tc.line(i))
+	}
+	return lines
+}
+
+// NumLines returns the number of lines in the source; 0-based line numbers run from 0 to
+// NumLines()-1. An empty source has no lines.
+func (tc *TreeContext) NumLines() int {
+	if len(tc.source) == 0 {
+		return 0
+	}
+	return tc.lastRealLine() + 1
+}
+
+// HighlightedLine returns the 0-based line as Format would print it, with the highlighting
+// added by Grep or HighlightMulti, and false if the line has no highlighting.
+func (tc *TreeContext) HighlightedLine(i int) (string, bool) {
+	defer tc.lock()()
+	hl, ok := tc.outputLines[i]
+	return hl, ok
+}
+
+// OriginalLine returns the unhighlighted source text of the 0-based line, or "" if the line
+// is outside the source.
+func (tc *TreeContext) OriginalLine(i int) string {
+	if i < 0 || i >= tc.NumLines() {
+		return ""
+	}
+	return string(tc.line(i))
+}
+
+// LinesOfInterest returns the 0-based lines of interest in ascending order.
+// The slice is a copy; modifying it doesn't affect the context.
+func (tc *TreeContext) LinesOfInterest() []int {
+	return mapKeysSorted(tc.linesOfInterest)
+}
+
+// ShowLines returns the 0-based lines selected for output in ascending order.
+// The slice is a copy; modifying it doesn't affect the context.
+func (tc *TreeContext) ShowLines() []int {
+	return mapKeysSorted(tc.showLines)
+}
+
+// LineRangeFragments returns the runs of consecutive shown lines as GitHub-style permalink
+// fragments, "L40-L52", or "L40" for a single line, in file order. Append one to a file URL
+// after a "#" to link to that part of the file.
+func (tc *TreeContext) LineRangeFragments() []string {
+	out := []string{}
+	for _, hunk := range tc.snippet().Hunks {
+		end := hunk.StartLine + len(hunk.Lines) - 1
+		if end == hunk.StartLine {
+			out = append(out, fmt.Sprintf("L%d", hunk.StartLine))
+		} else {
+			out = append(out, fmt.Sprintf("L%d-L%d", hunk.StartLine, end))
+		}
+	}
+	return out
+}
+
+// Matches returns the match spans the Grep variants recorded on the 0-based line, in order,
+// with byte offsets into the original (unhighlighted) line. Formatters can use them to
+// re-render matches in any style without running the pattern again. The slice is a copy.
+func (tc *TreeContext) Matches(line int) []Match {
+	defer tc.lock()()
+	return append([]Match(nil), tc.matches[line]...)
+}
+
+// MatchedLines returns the 0-based lines that have recorded match spans, in ascending order.
+func (tc *TreeContext) MatchedLines() []int {
+	defer tc.lock()()
+	lines := make([]int, 0, len(tc.matches))
+	for line := range tc.matches {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// ScopeStarts returns, in ascending order, the start lines of every scope that covers line.
+func (tc *TreeContext) ScopeStarts(line int) []int {
+	return append([]int{}, tc.scopesOf(line)...)
+}
+
+// Header returns the [start, end) range of lines shown as the header of the scope
+// starting at line, after HeaderMax truncation. It returns 0, 0 for lines outside the file.
+func (tc *TreeContext) Header(line int) (start, end int) {
+	if line < 0 || line >= len(tc.header) || len(tc.header[line]) < 2 {
+		return 0, 0
+	}
+	return tc.header[line][0], tc.header[line][1]
+}
+
+// ScopeLines returns every line of the scope starting at startLine, from startLine through the
+// last line of the largest node that starts there (e.g. a function's closing brace), for
+// folding UIs. It returns an empty slice if no node starts on startLine.
+func (tc *TreeContext) ScopeLines(startLine int) []int {
+	if startLine < 0 || startLine >= len(tc.nodes) || len(tc.nodes[startLine]) == 0 {
+		return []int{}
+	}
+	lastLine := tc.getLastLineOfScope(startLine)
+	lines := make([]int, 0, lastLine-startLine+1)
+	for ln := startLine; ln <= lastLine; ln++ {
+		lines = append(lines, ln)
+	}
+	return lines
+}
+
+// FindNodesByKind returns every named node whose kind is one of kinds, in pre-order.
+func (tc *TreeContext) FindNodesByKind(kinds ...string) []*sitter.Node {
+	return tc.findNodesByKind(kinds, 0)
+}
+
+// findNodesByKind is FindNodesByKind limited to nodes at most maxDepth below the root (0 = unlimited).
+func (tc *TreeContext) findNodesByKind(kinds []string, maxDepth int) []*sitter.Node {
+	want := make(map[string]struct{}, len(kinds))
+	for _, kind := range kinds {
+		want[kind] = struct{}{}
+	}
+
+	var out []*sitter.Node
+	tc.Walk(func(node *sitter.Node, depth int) bool {
+		if _, ok := want[node.Kind()]; ok && depth > 0 {
+			out = append(out, node)
+		}
+		return maxDepth == 0 || depth < maxDepth
+	})
+	return out
+}
+
+// FindByField returns the start lines of the nodes whose fieldName child (e.g. a
+// function's "name") has text matching pat. It's more precise than grepping the raw text.
+// It returns an error if pat is not a valid regular expression.
+func (tc *TreeContext) FindByField(fieldName, pat string) (map[int]struct{}, error) {
+	re, err := compilePattern(pat, false)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[int]struct{})
+	tc.Walk(func(node *sitter.Node, depth int) bool {
+		if field := node.ChildByFieldName(fieldName); field != nil && re.MatchString(field.Utf8Text(tc.source)) {
+			found[int(node.StartPosition().Row)] = struct{}{}
+		}
+		return true
+	})
+	return found, nil
+}
+
+// AddDeclarationHeaders marks the start line of every top-level declaration as a line of
+// interest, so AddContext renders an outline of the file without any pattern.
+func (tc *TreeContext) AddDeclarationHeaders() {
+	for _, node := range tc.findNodesByKind(declarationKinds[tc.language], 1) {
+		tc.AddLineOfInterest(int(node.StartPosition().Row))
+	}
+}
+
+// AddTopLevelStatements marks the start line of every top-level statement (each named child
+// of the root node except comments) as a line of interest. Unlike AddDeclarationHeaders it
+// needs no per-language tables, so together with AddContext it outlines any file, scripts
+// included.
+func (tc *TreeContext) AddTopLevelStatements() {
+	if tc.root == nil {
+		return
+	}
+	comments := commentKindsFor(tc.language)
+	for i := uint(0); i < tc.root.NamedChildCount(); i++ {
+		child := tc.root.NamedChild(i)
+		if child == nil {
+			continue
+		}
+		if _, isComment := comments[child.Kind()]; isComment {
+			continue
+		}
+		tc.AddLineOfInterest(int(child.StartPosition().Row))
+	}
+}
+
 // AddContext expands lines to show (showLines) based on linesOfInterest.
 func (tc *TreeContext) AddContext() {
-	if len(tc.linesOfInterest) == 0 {
+	if len(tc.linesOfInterest) == 0 || tc.blank {
 		return
 	}
 
+	// Visit lines of interest in order, so the child-context budget and therefore the
+	// output don't depend on map iteration order.
+	lois := mapKeysSorted(tc.linesOfInterest)
+
 	// Ensure all linesOfInterest are in showLines
-	for line := range tc.linesOfInterest {
+	for _, line := range lois {
 		tc.showLines[line] = struct{}{}
 	}
 
@@ -232,43 +1245,316 @@ func (tc *TreeContext) AddContext() {
 		}
 	}
 
+	// Reveal the whole statement around each LOI
+	if tc.expandToStatement {
+		for _, i := range lois {
+			if stmt := tc.enclosingStatement(i); stmt != nil {
+				for ln := int(stmt.StartPosition().Row); ln <= int(stmt.EndPosition().Row) && ln < len(tc.lineStarts); ln++ {
+					tc.showLines[ln] = struct{}{}
+				}
+			}
+		}
+	}
+
 	// Optionally add bottom line (plus parent context)
 	if tc.lastLine {
-		bottomLine := tc.numLines - 2
+		bottomLine := tc.lastRealLine()
 		tc.showLines[bottomLine] = struct{}{}
 		tc.addParentScopes(bottomLine)
 	}
 
+	// Optionally add just the last line with content
+	if tc.finalLine {
+		for i := tc.lastRealLine(); i >= 0; i-- {
+			if len(bytes.TrimSpace(tc.line(i))) > 0 {
+				tc.showLines[i] = struct{}{}
+				break
+			}
+		}
+	}
+
 	// Add parent contexts
+	beforeParents := copyLineSet(tc.showLines)
 	if tc.parentContext {
-		for i := range tc.linesOfInterest {
+		for _, i := range lois {
 			tc.addParentScopes(i)
 		}
 	}
+	parentLines := addedLines(beforeParents, tc.showLines)
 
 	// Add child contexts
 	// NOTE: This is where we fix partial expansions. If you want the entire function body,
 	// you can remove or adjust the logic in addChildContext.
 	if tc.childContext {
-		for i := range tc.linesOfInterest {
+		for _, i := range lois {
 			tc.addChildContext(i)
 		}
 	}
 
-	// Add top margin lines
-	if tc.margin > 0 {
-		for i := 0; i < tc.margin && i < tc.numLines; i++ {
+	// Add the signatures of neighbouring declarations
+	if tc.siblingSignatures {
+		for _, i := range lois {
+			tc.addSiblingSignatures(i)
+		}
+	}
+
+	// Add package and import declarations
+	if tc.showImports {
+		tc.addImports()
+	}
+
+	// Add build constraints
+	if tc.buildDirectives {
+		tc.addBuildDirectives()
+	}
+
+	// Add top margin lines
+	marginLines := make(map[int]struct{})
+	if tc.margin > 0 && (!tc.marginOnlyWithTopMatch || tc.hasLineOfInterestBefore(tc.margin)) {
+		for i := 0; i < tc.margin && i < tc.numLines; i++ {
+			if !tc.isShown(i) {
+				marginLines[i] = struct{}{}
+			}
+			tc.showLines[i] = struct{}{}
+		}
+	}
+
+	// Close small gaps between lines to produce a smoother snippet
+	tc.closeSmallGaps()
+
+	// Enforce the line cap, trimming the least important context
+	tc.parentShown, tc.marginShown = parentLines, marginLines
+	tc.truncated = false
+	if tc.maxOutputLines > 0 && len(tc.showLines) > tc.maxOutputLines {
+		tc.trimToMaxOutputLines()
+	}
+}
+
+// trimToMaxOutputLines drops shown lines, in droppableLines order, until at most
+// maxOutputLines remain. Lines of interest are never dropped, even if they alone exceed the cap.
+func (tc *TreeContext) trimToMaxOutputLines() {
+	for _, line := range tc.droppableLines(tc.linesOfInterest) {
+		if len(tc.showLines) <= tc.maxOutputLines {
+			break
+		}
+		delete(tc.showLines, line)
+		tc.truncated = true
+	}
+
+	// drop the trimmed lines from the slice closeSmallGaps sorted
+	kept := tc.sortedShow[:0]
+	for _, line := range tc.sortedShow {
+		if _, ok := tc.showLines[line]; ok {
+			kept = append(kept, line)
+		}
+	}
+	tc.sortedShow = kept
+}
+
+// droppableLines returns the shown lines not in keep, least important first: child context
+// and other incidental lines (padding, imports, gap fills), then the top margin, then the
+// parent headers; within each group the lines farthest from a line of interest go first.
+func (tc *TreeContext) droppableLines(keep map[int]struct{}) []int {
+	rank := func(line int) int {
+		if _, ok := tc.parentShown[line]; ok {
+			return 2
+		}
+		if _, ok := tc.marginShown[line]; ok {
+			return 1
+		}
+		return 0
+	}
+
+	var droppable []int
+	for _, line := range mapKeysSorted(tc.showLines) {
+		if _, kept := keep[line]; !kept {
+			droppable = append(droppable, line)
+		}
+	}
+	lois := mapKeysSorted(tc.linesOfInterest)
+	sort.SliceStable(droppable, func(a, b int) bool {
+		if ra, rb := rank(droppable[a]), rank(droppable[b]); ra != rb {
+			return ra < rb
+		}
+		return distanceToNearest(droppable[a], lois) > distanceToNearest(droppable[b], lois)
+	})
+	return droppable
+}
+
+// Truncated reports whether the last AddContext dropped context lines to respect MaxOutputLines.
+func (tc *TreeContext) Truncated() bool {
+	return tc.truncated
+}
+
+// enclosingStatement returns the smallest statement or expression node that covers all of
+// line i's code, looked up through the nodes starting on the scopes around i. Compound
+// statements with a block (if, for, ...) are skipped so their bodies aren't revealed.
+func (tc *TreeContext) enclosingStatement(i int) *sitter.Node {
+	if i < 0 || i >= len(tc.lineStarts) {
+		return nil
+	}
+	line := tc.line(i)
+	firstCol := uint(len(line) - len(bytes.TrimLeft(line, " \t")))
+	lastCol := uint(len(bytes.TrimRight(line, " \t\r")))
+	if firstCol >= lastCol {
+		return nil
+	}
+
+	var best *sitter.Node
+	for _, start := range tc.scopesOf(i) {
+		if start < 0 || start >= len(tc.nodes) {
+			continue
+		}
+		for _, node := range tc.nodes[start] {
+			if !isStatementKind(node) {
+				continue
+			}
+			from, to := node.StartPosition(), node.EndPosition()
+			coversStart := int(from.Row) < i || (int(from.Row) == i && from.Column <= firstCol)
+			coversEnd := int(to.Row) > i || (int(to.Row) == i && to.Column >= lastCol)
+			if !coversStart || !coversEnd {
+				continue
+			}
+			if best == nil || node.EndByte()-node.StartByte() < best.EndByte()-best.StartByte() {
+				best = node
+			}
+		}
+	}
+	return best
+}
+
+// isStatementKind reports whether node is a simple statement or expression, i.e. one
+// whose kind says so and that has no block of its own.
+func isStatementKind(node *sitter.Node) bool {
+	kind := node.Kind()
+	if !strings.HasSuffix(kind, "statement") && !strings.HasSuffix(kind, "expression") &&
+		!strings.HasSuffix(kind, "declaration") && kind != "assignment" {
+		return false
+	}
+	if node.ChildByFieldName("body") != nil {
+		return false
+	}
+	for n := uint(0); n < node.NamedChildCount(); n++ {
+		if child := node.NamedChild(n); child != nil && strings.Contains(child.Kind(), "block") {
+			return false
+		}
+	}
+	return true
+}
+
+// hasLineOfInterestBefore reports whether any line of interest is above line n.
+func (tc *TreeContext) hasLineOfInterestBefore(n int) bool {
+	for line := range tc.linesOfInterest {
+		if line < n {
+			return true
+		}
+	}
+	return false
+}
+
+// addSiblingSignatures finds the innermost declaration containing line i and shows the
+// signature of every other declaration under the same parent, e.g. the other methods of a
+// class. A signature runs from the declaration's first line to the line its body opens on;
+// declarations without a body field show just their first line.
+func (tc *TreeContext) addSiblingSignatures(i int) {
+	if i < 0 || i >= len(tc.lineStarts) {
+		return
+	}
+	kinds := make(map[string]struct{})
+	for _, kind := range declarationKinds[tc.language] {
+		kinds[kind] = struct{}{}
+	}
+	for kind := range symbolKinds[tc.language] {
+		kinds[kind] = struct{}{}
+	}
+
+	col := len(tc.line(i)) - len(bytes.TrimLeft(tc.line(i), " \t"))
+	decl := tc.NodeAt(i, col)
+	for decl != nil {
+		if _, ok := kinds[decl.Kind()]; ok {
+			break
+		}
+		decl = decl.Parent()
+	}
+	if decl == nil || decl.Parent() == nil {
+		return
+	}
+
+	parent := decl.Parent()
+	for n := uint(0); n < parent.NamedChildCount(); n++ {
+		sibling := parent.NamedChild(n)
+		if sibling == nil || sibling.Id() == decl.Id() {
+			continue
+		}
+		if _, ok := kinds[sibling.Kind()]; !ok {
+			continue
+		}
+		start, end := int(sibling.StartPosition().Row), int(sibling.StartPosition().Row)
+		if body := sibling.ChildByFieldName("body"); body != nil {
+			end = int(body.StartPosition().Row)
+		}
+		for ln := start; ln <= end && ln < len(tc.lineStarts); ln++ {
+			tc.showLines[ln] = struct{}{}
+		}
+	}
+}
+
+// importKinds are the top-level node kinds that declare a file's package or dependencies.
+var importKinds = map[string]struct{}{
+	"package_clause":           {}, // go
+	"import_declaration":       {}, // go, java
+	"package_declaration":      {}, // java
+	"import_statement":         {}, // python, javascript, typescript
+	"import_from_statement":    {}, // python
+	"future_import_statement":  {}, // python
+	"use_declaration":          {}, // rust
+	"extern_crate_declaration": {}, // rust
+	"using_directive":          {}, // c_sharp
+}
+
+// addImports shows every line of the top-level package/import declarations.
+func (tc *TreeContext) addImports() {
+	if tc.root == nil {
+		return
+	}
+	for i := uint(0); i < tc.root.NamedChildCount(); i++ {
+		child := tc.root.NamedChild(i)
+		if child == nil {
+			continue
+		}
+		if _, ok := importKinds[child.Kind()]; !ok {
+			continue
+		}
+		for ln := int(child.StartPosition().Row); ln <= int(child.EndPosition().Row) && ln < len(tc.lineStarts); ln++ {
+			tc.showLines[ln] = struct{}{}
+		}
+	}
+}
+
+// addBuildDirectives shows the build constraint (//go:build, // +build) and //go: directive
+// lines in the comment block at the top of a Go file, i.e. before the first line of code.
+func (tc *TreeContext) addBuildDirectives() {
+	if tc.language != "go" {
+		return
+	}
+	for i := range tc.lineStarts {
+		line := tc.line(i)
+		text := string(bytes.TrimSpace(line))
+		if text != "" && !strings.HasPrefix(text, "//") {
+			break
+		}
+		if strings.HasPrefix(text, "//go:") || strings.HasPrefix(text, "// +build") {
 			tc.showLines[i] = struct{}{}
 		}
 	}
-
-	// Close small gaps between lines to produce a smoother snippet
-	tc.closeSmallGaps()
 }
 
+// defaultSmallScopeThreshold is the SmallScopeThreshold used when none is set.
+const defaultSmallScopeThreshold = 5
+
 // addChildContext tries to show a child scope for the line i (e.g. function body),
-// replicating the Python logic more closely.  If the scope is small (<5 lines),
-// we reveal everything.  Otherwise, we show partial expansions by calling
+// replicating the Python logic more closely.  If the scope is small (at most
+// SmallScopeThreshold lines), we reveal everything.  Otherwise, we show partial expansions by calling
 // addParentScopes(childStart) for each child, up to a max limit.
 func (tc *TreeContext) addChildContext(i int) {
 	if i < 0 || i >= len(tc.nodes) {
@@ -285,7 +1571,11 @@ func (tc *TreeContext) addChildContext(i int) {
 	}
 
 	// If the scope is small enough, reveal everything.
-	if size < 5 {
+	threshold := tc.smallScopeThreshold
+	if threshold <= 0 {
+		threshold = defaultSmallScopeThreshold
+	}
+	if size+1 <= threshold {
 		for line := i; line <= lastLine && line < tc.numLines; line++ {
 			tc.showLines[line] = struct{}{}
 		}
@@ -299,7 +1589,19 @@ func (tc *TreeContext) addChildContext(i int) {
 	}
 	sortNodesBySize(children)
 
-	currentlyShowing := len(tc.showLines)
+	// The budget counts the body lines each child newly reveals. Header lines of the scopes
+	// around i are revealed by whichever child reaches them first (or were already shown by
+	// another line of interest in the same scope), so they don't count against it.
+	headers := tc.parentHeaderLines(i)
+	newBodyLines := func(child int) int {
+		n := 0
+		for ln := range tc.parentHeaderLines(child) {
+			if _, isHeader := headers[ln]; !isHeader && ln > i && ln <= lastLine && !tc.isShown(ln) {
+				n++
+			}
+		}
+		return n
+	}
 
 	// We only reveal ~10% of the larger scope, at least 5 lines, at most 25 lines,
 	// matching the Python logic.
@@ -313,135 +1615,573 @@ func (tc *TreeContext) addChildContext(i int) {
 		computedMax = maxToShow
 	}
 
-	// For each child, we only expand up to computedMax times by revealing
-	// its parent scopes.  (Mirrors Python's "self.add_parent_scopes(child_start_line)")
+	// For each child, reveal its parent scopes (mirrors Python's
+	// "self.add_parent_scopes(child_start_line)"), skipping children whose headers alone
+	// would overshoot the budget so smaller ones further down can still use it.
+	revealed := 0
 	for _, child := range children {
-		if len(tc.showLines) > currentlyShowing+computedMax {
+		if revealed >= computedMax {
 			break
 		}
 		childStart := int(child.StartPosition().Row)
-		// childEnd := int(child.EndPosition().Row)
-		// for line := childStart; line <= childEnd && line < tc.numLines; line++ {
-		// 	tc.showLines[line] = struct{}{}
-		// }
+		if _, done := tc.doneParentScopes[childStart]; done {
+			continue
+		}
+		n := newBodyLines(childStart)
+		if n > 0 && revealed+n > computedMax {
+			continue
+		}
 		tc.addParentScopes(childStart)
+		revealed += n
 	}
 }
 
-// findAllChildren gathers all descendants (recursive)
+// findAllChildren gathers all named descendants in pre-order. It uses an explicit
+// stack so pathologically deep trees can't exhaust the goroutine stack.
 func (tc *TreeContext) findAllChildren(node *sitter.Node) []*sitter.Node {
-	out := []*sitter.Node{node}
-	for i := uint(0); i < node.ChildCount(); i++ {
-		if child := node.NamedChild(i); child != nil {
-			out = append(out, tc.findAllChildren(child)...)
+	var out []*sitter.Node
+	stack := []*sitter.Node{node}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		out = append(out, n)
+		// push in reverse so children pop in source order
+		for i := tc.childCount(n); i > 0; i-- {
+			if child := tc.child(n, i-1); child != nil {
+				stack = append(stack, child)
+			}
 		}
 	}
 	return out
 }
 
-// getLastLineOfScope finds the maximum end_line for nodes that start on line i
+// getLastLineOfScope finds the maximum end_line for nodes that start on line i.
+// Results are memoized since the parse-derived nodes never change.
 func (tc *TreeContext) getLastLineOfScope(i int) int {
 	if i < 0 || i >= len(tc.nodes) || len(tc.nodes[i]) == 0 {
 		return i
 	}
+	if lastLine, ok := tc.lastLineOfScope[i]; ok {
+		return lastLine
+	}
 	lastLine := 0
 	for _, node := range tc.nodes[i] {
 		if int(node.EndPosition().Row) > lastLine {
 			lastLine = int(node.EndPosition().Row)
 		}
 	}
+	if tc.lastLineOfScope == nil {
+		tc.lastLineOfScope = make(map[int]int)
+	}
+	tc.lastLineOfScope[i] = lastLine
 	return lastLine
 }
 
-// closeSmallGaps closes single-line gaps.
+// closeSmallGaps closes single-line gaps and picks up the blank line after each shown line.
+// It sorts showLines once, extending the sorted slice as it goes, and caches it in sortedShow.
 func (tc *TreeContext) closeSmallGaps() {
-	closedShow := make(map[int]struct{}, len(tc.showLines))
-	for k := range tc.showLines {
-		closedShow[k] = struct{}{}
-	}
-
-	sortedShow := mapKeysSorted(tc.showLines)
+	shown := mapKeysSorted(tc.showLines)
 
 	// fill i+1 if i and i+2 are present
-	for i := 0; i < len(sortedShow)-1; i++ {
-		curr := sortedShow[i]
-		next := sortedShow[i+1]
-		if next-curr == 2 {
-			closedShow[curr+1] = struct{}{}
+	closed := make([]int, 0, len(shown))
+	for k, curr := range shown {
+		closed = append(closed, curr)
+		if k+1 < len(shown) && shown[k+1]-curr == 2 {
+			closed = append(closed, curr+1)
 		}
 	}
 
-	// pick up adjacent blank lines
-	for i, line := range tc.lines {
-		if _, ok := closedShow[i]; ok {
-			if strings.TrimSpace(line) != "" && i < tc.numLines-2 {
-				// check if next line is blank
-				if len(tc.lines) > i+1 && strings.TrimSpace(tc.lines[i+1]) == "" {
-					closedShow[i+1] = struct{}{}
-				}
+	// pick up adjacent blank lines, but never the phantom line after a trailing newline
+	if !tc.noBlankPickup {
+		last := tc.lastRealLine()
+		picked := make([]int, 0, len(closed))
+		for k, i := range closed {
+			picked = append(picked, i)
+			if i < 0 || i >= last || (k+1 < len(closed) && closed[k+1] == i+1) {
+				continue
+			}
+			if len(bytes.TrimSpace(tc.line(i))) > 0 && len(bytes.TrimSpace(tc.line(i+1))) == 0 {
+				picked = append(picked, i+1)
 			}
 		}
+		closed = picked
 	}
 
-	tc.showLines = closedShow
+	for _, i := range closed {
+		tc.showLines[i] = struct{}{}
+	}
+	tc.sortedShow = closed
+}
+
+// lastRealLine returns the index of the last line of the source, not counting the empty
+// element strings.Split leaves after a trailing newline.
+func (tc *TreeContext) lastRealLine() int {
+	last := len(tc.lineStarts) - 1
+	if last > 0 && len(tc.line(last)) == 0 && len(tc.source) > 0 && tc.source[len(tc.source)-1] == '\n' {
+		last--
+	}
+	return last
 }
 
 // Format outputs the final lines. This version prints an initial ellipsis
 // if the first line is NOT in showLines, replicating the Python code's
 // "dots = not (0 in self.show_lines)" behavior.
 func (tc *TreeContext) Format() string {
-	if len(tc.showLines) == 0 {
+	var sb strings.Builder
+	tc.formatTo(&sb)
+	return sb.String()
+}
+
+// FormatTo writes the same output as Format to w. Unless w already buffers
+// (*bufio.Writer, *bytes.Buffer, *strings.Builder), writes go through a bufio.Writer
+// that is flushed before returning.
+func (tc *TreeContext) FormatTo(w io.Writer) error {
+	_, err := tc.formatToBuffered(w)
+	return err
+}
+
+// ShowAll selects every line of the file, so Format renders it in full (no ellipses)
+// with the usual gutters, markers and highlighting.
+func (tc *TreeContext) ShowAll() {
+	for i := 0; i <= tc.lastRealLine(); i++ {
+		tc.showLines[i] = struct{}{}
+	}
+	tc.invalidateShown()
+}
+
+// FormatMatchesOnly selects exactly the lines of interest, with no padding, parent, child
+// or margin context, and formats them. Like grep without -C, but with highlighting and gutters.
+func (tc *TreeContext) FormatMatchesOnly() string {
+	tc.showLines = make(map[int]struct{}, len(tc.linesOfInterest))
+	for line := range tc.linesOfInterest {
+		tc.showLines[line] = struct{}{}
+	}
+	tc.invalidateShown()
+	return tc.Format()
+}
+
+// FormatGrepStyle emits one filename:lineno:content line per line of interest, like grep -n,
+// with no gutter, ellipses or color. It's meant for tools that consume grep output.
+func (tc *TreeContext) FormatGrepStyle() string {
+	var sb strings.Builder
+	for _, i := range tc.LinesOfInterest() {
+		if i < 0 || i >= len(tc.lineStarts) {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s:%d:%s\n", tc.filename, i+1, tc.line(i))
+	}
+	return sb.String()
+}
+
+// FormatMarkdown wraps the formatted snippet in a fenced code block tagged with the file's
+// language. Color escapes are always left out since Markdown can't render them. The fence is
+// made longer than any backtick run in the snippet so it can't be closed early.
+func (tc *TreeContext) FormatMarkdown() string {
+	var body strings.Builder
+	tc.formatPlain(&body)
+
+	fence := "```"
+	for strings.Contains(body.String(), fence) {
+		fence += "`"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fence + markdownLanguage(tc.language) + "\n")
+	sb.WriteString(body.String())
+	sb.WriteString(fence + "\n")
+	return sb.String()
+}
+
+// FormatHTML renders the lines Format would show as HTML for web viewers: one
+// <div class="line"> per line (with a "loi" class on lines of interest) holding the line
+// number, if ShowLineNumber is set, and the escaped source, matched spans wrapped in
+// <span class="match">, and gaps as <div class="ellipsis">.
+func (tc *TreeContext) FormatHTML() string {
+	if len(tc.showLines) == 0 || tc.blank {
 		return ""
 	}
 
 	var sb strings.Builder
+	sb.WriteString("<div class=\"grep-ast\">\n")
+	tc.eachFormatLine(func(i int) bool {
+		class := "line"
+		if _, isLOI := tc.linesOfInterest[i]; isLOI {
+			class += " loi"
+		}
+		fmt.Fprintf(&sb, "<div class=\"%s\">", class)
+		if tc.lineNumber {
+			fmt.Fprintf(&sb, "<span class=\"lineno\">%d</span>", i+1)
+		}
+		sb.WriteString("<span class=\"code\">")
+		line, at := string(tc.line(i)), 0
+		for _, m := range tc.matches[i] {
+			sb.WriteString(html.EscapeString(line[at:m.Start]))
+			sb.WriteString("<span class=\"match\">" + html.EscapeString(line[m.Start:m.End]) + "</span>")
+			at = m.End
+		}
+		sb.WriteString(html.EscapeString(line[at:]))
+		sb.WriteString("</span></div>\n")
+		return true
+	}, func(first int) bool {
+		sb.WriteString("<div class=\"ellipsis\">⋮...</div>\n")
+		return true
+	})
+	sb.WriteString("</div>\n")
+	return sb.String()
+}
+
+// formatPlain is formatTo without any color escapes or highlighting.
+func (tc *TreeContext) formatPlain(w io.Writer) (int64, error) {
+	color, outputLines := tc.color, tc.outputLines
+	tc.color, tc.outputLines = false, nil
+	defer func() { tc.color, tc.outputLines = color, outputLines }()
+	return tc.formatTo(w)
+}
+
+// markdownLanguage returns the info string Markdown renderers use to highlight lang.
+func markdownLanguage(lang string) string {
+	switch lang {
+	case "c_sharp":
+		return "csharp"
+	case "make":
+		return "makefile"
+	}
+	return lang
+}
+
+// String implements fmt.Stringer by returning Format's output, which is empty until
+// lines of interest and context have been added.
+func (tc *TreeContext) String() string {
+	return tc.Format()
+}
+
+// WriteTo implements io.WriterTo, streaming the same bytes as Format to w.
+func (tc *TreeContext) WriteTo(w io.Writer) (int64, error) {
+	return tc.formatToBuffered(w)
+}
+
+// formatToBuffered is FormatTo, also reporting the number of bytes written to w.
+func (tc *TreeContext) formatToBuffered(w io.Writer) (int64, error) {
+	switch w.(type) {
+	case *bufio.Writer, *bytes.Buffer, *strings.Builder:
+		return tc.formatTo(w)
+	}
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	if _, err := tc.formatTo(bw); err != nil {
+		return cw.n, err
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// formatTo writes the formatted output to w, returning the bytes written and the first write error.
+func (tc *TreeContext) formatTo(w io.Writer) (int64, error) {
+	if len(tc.showLines) == 0 || tc.blank {
+		return 0, nil
+	}
+
+	cw := &countingWriter{w: w}
 
 	// Optional color reset at the start
-	if tc.color {
-		sb.WriteString("\033[0m\n")
+	if tc.color && !tc.noLeadingReset {
+		io.WriteString(cw, "\033[0m\n")
 	}
 
-	// If the first line is *not* in showLines, we begin in "ellipses" mode,
-	// so we will print an ellipsis when we next skip lines.
-	_, firstLineShown := tc.showLines[0]
-	printEllipsis := !firstLineShown
+	tc.FormatEach(func(lineNum int, text string, isLOI, isEllipsis bool) bool {
+		io.WriteString(cw, text)
+		io.WriteString(cw, "\n")
+		return cw.err == nil
+	})
+	return cw.n, cw.err
+}
 
-	for i, line := range tc.lines {
-		_, shouldShow := tc.showLines[i]
-		if !shouldShow {
-			// Print ellipsis once after last shown line
-			if printEllipsis {
-				sb.WriteString("⋮...\n")
-				printEllipsis = false
-			}
-			continue
-		}
+// FormatEach calls fn for each line Format would output, in order, with the text of the line
+// (without its "\n") instead of building the whole string, e.g. to render progressively.
+// lineNum is the 1-based source line; for an ellipsis it is the first hidden line, and a
+// caret underline repeats the number of the line it underlines. Returning false from fn
+// stops formatting. The color reset Format starts colored output with is not included.
+func (tc *TreeContext) FormatEach(fn func(lineNum int, text string, isLOI, isEllipsis bool) bool) {
+	shown := tc.formatLines()
+	lineNumberFormat := tc.lineNumberVerb(shown)
+	tc.eachFormatLine(func(i int) bool {
+		line := string(tc.line(i))
+		_, isLOI := tc.linesOfInterest[i]
 
 		// Show the line
 		spacer := tc.lineOfInterestSpacer(i)
 		oline := tc.highlightedOrOriginalLine(i, line)
+		if _, cut := tc.truncatedHeaders[i]; cut && !tc.isShown(i+1) {
+			oline += tc.truncationMarker
+		}
+		var num string
 		if tc.lineNumber {
-			fmt.Fprintf(&sb, "%3d%s%s\n", i+1, spacer, oline)
-		} else {
-			fmt.Fprintf(&sb, "%s%s\n", spacer, oline)
+			num = fmt.Sprintf(lineNumberFormat, i+1)
+		}
+		if !fn(i+1, num+spacer+oline, isLOI, false) {
+			return false
+		}
+
+		// Optionally underline the matched spans
+		if caret := tc.caretLine(i, line); caret != "" {
+			pad := strings.Repeat(" ", displayWidth(num))
+			return fn(i+1, pad+tc.gutter(tc.separatorGlyph())+caret, isLOI, false)
 		}
+		return true
+	}, func(first int) bool {
+		return fn(first+1, "⋮...", false, true)
+	})
+}
 
-		// If we skip lines after this, we want an ellipsis
-		printEllipsis = true
+// eachFormatLine walks the lines Format renders, in order: it calls line for every shown
+// 0-based line and gap before each run of hidden lines, including one before the first shown
+// line and after the last, with the first hidden line. Either returning false stops the walk.
+func (tc *TreeContext) eachFormatLine(line func(i int) bool, gap func(first int) bool) {
+	if len(tc.showLines) == 0 || tc.blank {
+		return
 	}
 
-	return sb.String()
+	last := tc.lastRealLine()
+	prev := -1
+	for _, i := range tc.formatLines() {
+		if i < 0 || i > last {
+			continue
+		}
+		if i > prev+1 && !gap(prev+1) {
+			return
+		}
+		if !line(i) {
+			return
+		}
+		prev = i
+	}
+	if prev < last {
+		gap(prev + 1)
+	}
+}
+
+// formatLines returns the shown lines in the order Format renders them. With DropTinyHunks,
+// a lone context line with elided gaps on both sides is left out, so its two ellipses merge
+// into one; lines of interest are always kept.
+func (tc *TreeContext) formatLines() []int {
+	shown := tc.sortedShowLines()
+	if !tc.dropTinyHunks {
+		return shown
+	}
+
+	out := make([]int, 0, len(shown))
+	for _, i := range shown {
+		_, isLOI := tc.linesOfInterest[i]
+		island := i > 0 && i < tc.lastRealLine() && !tc.isShown(i-1) && !tc.isShown(i+1)
+		if island && !isLOI {
+			continue
+		}
+		out = append(out, i)
+	}
+	return out
+}
+
+// isShown reports whether line i is in showLines.
+func (tc *TreeContext) isShown(i int) bool {
+	_, ok := tc.showLines[i]
+	return ok
+}
+
+// FormatStats summarizes what Format shows.
+type FormatStats struct {
+	ShownLines  int // Lines of the file that are shown.
+	HiddenLines int // Lines of the file that are elided.
+	HunkCount   int // Runs of consecutive shown lines.
+	MatchCount  int // Lines of interest.
+}
+
+// Stats reports how much of the file the current selection shows, e.g. for a
+// "showing 30 of 500 lines across 4 matches" summary above the snippet.
+func (tc *TreeContext) Stats() FormatStats {
+	var st FormatStats
+	total := tc.lastRealLine() + 1
+	if tc.blank {
+		total = 0
+	}
+
+	prev := -2
+	for _, i := range tc.formatLines() {
+		if i < 0 || i >= total {
+			continue
+		}
+		st.ShownLines++
+		if i != prev+1 {
+			st.HunkCount++
+		}
+		prev = i
+	}
+	st.HiddenLines = total - st.ShownLines
+	st.MatchCount = len(tc.linesOfInterest)
+	return st
+}
+
+// lineNumberVerb returns the format for line numbers: LineNumberFormat if set, otherwise
+// %Nd with N wide enough for the largest shown line number (at least 3).
+func (tc *TreeContext) lineNumberVerb(shown []int) string {
+	if tc.lineNumberFormat != "" {
+		return tc.lineNumberFormat
+	}
+	width := 3
+	if len(shown) > 0 {
+		if w := len(strconv.Itoa(shown[len(shown)-1] + 1)); w > width {
+			width = w
+		}
+	}
+	return "%" + strconv.Itoa(width) + "d"
+}
+
+// FormatWithinBudget formats the output like Format, but leaves out shown lines until the
+// estimated token count fits within MaxOutputTokens. Lines are dropped in the order
+// MaxOutputLines trims them, child context first; lines of interest and their parent headers
+// are always kept. The selection itself is unchanged, so Format still renders all of it.
+func (tc *TreeContext) FormatWithinBudget() string {
+	out := tc.Format()
+	if tc.maxOutputTokens <= 0 || estimateTokens(out) <= tc.maxOutputTokens {
+		return out
+	}
+
+	// Lines that must never be dropped.
+	keep := make(map[int]struct{})
+	for loi := range tc.linesOfInterest {
+		keep[loi] = struct{}{}
+		for line := range tc.parentHeaderLines(loi) {
+			keep[line] = struct{}{}
+		}
+	}
+	droppable := tc.droppableLines(keep)
+
+	// Trim a copy of the selection, restoring the original once formatted.
+	saved, savedSorted := tc.showLines, tc.sortedShow
+	defer func() { tc.showLines, tc.sortedShow = saved, savedSorted }()
+	tc.showLines = copyLineSet(saved)
+
+	for len(droppable) > 0 && estimateTokens(out) > tc.maxOutputTokens {
+		// Subtract each dropped line's share of the output instead of formatting after every
+		// line; new ellipses aren't counted, so check the result and go again if needed.
+		cost := tc.lineCosts()
+		size := len(out)
+		for len(droppable) > 0 && (size+3)/4 > tc.maxOutputTokens {
+			size -= cost[droppable[0]]
+			delete(tc.showLines, droppable[0])
+			droppable = droppable[1:]
+		}
+		tc.invalidateShown()
+		out = tc.Format()
+	}
+	return out
+}
+
+// lineCosts returns the number of output bytes Format spends on each shown 0-based line,
+// including its caret underline.
+func (tc *TreeContext) lineCosts() map[int]int {
+	cost := make(map[int]int, len(tc.showLines))
+	tc.FormatEach(func(lineNum int, text string, isLOI, isEllipsis bool) bool {
+		if !isEllipsis {
+			cost[lineNum-1] += len(text) + 1
+		}
+		return true
+	})
+	return cost
+}
+
+// parentHeaderLines returns the header lines addParentScopes would reveal for line i.
+func (tc *TreeContext) parentHeaderLines(i int) map[int]struct{} {
+	out := make(map[int]struct{})
+	for _, lineNum := range tc.scopesOf(i) {
+		headerSlice := tc.header[lineNum]
+		if len(headerSlice) < 2 {
+			continue
+		}
+		headStart, headEnd := headerSlice[0], headerSlice[1]
+		if headStart > 0 || tc.showTopOfFileParentScope {
+			for ln := headStart; ln < headEnd && ln < tc.numLines; ln++ {
+				out[ln] = struct{}{}
+			}
+			if pkg := tc.topOfFilePackageLine(lineNum); pkg >= 0 {
+				out[pkg] = struct{}{}
+			}
+		}
+	}
+	return out
+}
+
+// invalidateShown drops the cached sortedShow; call it after changing showLines.
+func (tc *TreeContext) invalidateShown() {
+	tc.sortedShow = nil
+}
+
+// sortedShowLines returns showLines in ascending order, using the cached copy unless
+// invalidateShown dropped it.
+func (tc *TreeContext) sortedShowLines() []int {
+	if tc.sortedShow == nil {
+		tc.sortedShow = mapKeysSorted(tc.showLines)
+	}
+	return tc.sortedShow
+}
+
+// caretLine returns a line of carets aligned under the matched spans of line i,
+// or an empty string if the line isn't an underlined line of interest. Match spans are
+// byte offsets, so the padding and carets are sized by display width: a wide CJK rune
+// before or inside a match takes two columns, a combining mark none.
+func (tc *TreeContext) caretLine(i int, line string) string {
+	if !tc.caretUnderline {
+		return ""
+	}
+	if _, isLOI := tc.linesOfInterest[i]; !isLOI || len(tc.matches[i]) == 0 {
+		return ""
+	}
+
+	var under strings.Builder
+	pos := 0
+	for _, m := range tc.matches[i] {
+		if m.Start < pos || m.End > len(line) {
+			continue
+		}
+		// pad up to the match, keeping tabs so the carets line up with the source
+		for _, r := range line[pos:m.Start] {
+			if r == '\t' {
+				under.WriteByte('\t')
+			} else {
+				under.WriteString(strings.Repeat(" ", runeWidth(r)))
+			}
+		}
+		under.WriteString(strings.Repeat("^", displayWidth(line[m.Start:m.End])))
+		pos = m.End
+	}
+	return under.String()
 }
 
-// lineOfInterestSpacer returns "│" or "█" (with color if needed)
+// lineOfInterestSpacer returns the separator or "█" (with color if needed), padded if PadSeparator is set
 func (tc *TreeContext) lineOfInterestSpacer(i int) string {
 	if _, isLOI := tc.linesOfInterest[i]; isLOI && tc.markLOIs {
 		if tc.color {
-			return "\033[31m█\033[0m"
+			return tc.gutter("\033[31m█\033[0m")
 		}
-		return "█"
+		return tc.gutter("█")
+	}
+	return tc.gutter(tc.separatorGlyph())
+}
+
+// separatorGlyph returns the configured gutter glyph, "│" by default.
+func (tc *TreeContext) separatorGlyph() string {
+	if tc.separator == "" {
+		return "│"
+	}
+	return tc.separator
+}
+
+// gutter pads glyph with a space on either side if PadSeparator is set.
+func (tc *TreeContext) gutter(glyph string) string {
+	if tc.padSeparator {
+		return " " + glyph + " "
 	}
-	return "│"
+	return glyph
 }
 
 // highlightedOrOriginalLine uses the highlighted version if present
@@ -454,7 +2194,7 @@ func (tc *TreeContext) highlightedOrOriginalLine(i int, original string) string
 
 // addParentScopes recursively shows lines for parent scopes
 func (tc *TreeContext) addParentScopes(i int) {
-	if i < 0 || i >= len(tc.scopes) {
+	if i < 0 || i >= len(tc.scopeEnd) {
 		return
 	}
 	if _, done := tc.doneParentScopes[i]; done {
@@ -463,7 +2203,7 @@ func (tc *TreeContext) addParentScopes(i int) {
 	tc.doneParentScopes[i] = struct{}{}
 
 	// for each scope that starts at line_num
-	for lineNum := range tc.scopes[i] {
+	for _, lineNum := range tc.scopesOf(i) {
 		headerSlice := tc.header[lineNum]
 		if len(headerSlice) >= 2 {
 			headStart := headerSlice[0]
@@ -472,6 +2212,24 @@ func (tc *TreeContext) addParentScopes(i int) {
 				for ln := headStart; ln < headEnd && ln < tc.numLines; ln++ {
 					tc.showLines[ln] = struct{}{}
 				}
+				// the top-of-file scope's header is often just a license comment
+				if pkg := tc.topOfFilePackageLine(lineNum); pkg >= 0 {
+					tc.showLines[pkg] = struct{}{}
+				}
+				// optionally add the decorators and doc comment above the scope
+				above := headStart
+				if tc.annotations {
+					above = tc.addAnnotations(headStart)
+				}
+				if tc.leadingComments {
+					tc.addLeadingComments(above)
+				}
+				// optionally add the scope's closing line
+				if tc.scopeClosers {
+					if closer := tc.getLastLineOfScope(lineNum); closer < len(tc.lineStarts) {
+						tc.showLines[closer] = struct{}{}
+					}
+				}
 			}
 			// optionally add last line
 			if tc.lastLine {
@@ -482,6 +2240,117 @@ func (tc *TreeContext) addParentScopes(i int) {
 	}
 }
 
+// packageKinds are the top-level node kinds that name a file's package or namespace.
+var packageKinds = map[string]struct{}{
+	"package_clause":                    {}, // go
+	"package_declaration":               {}, // java
+	"file_scoped_namespace_declaration": {}, // c_sharp
+}
+
+// topOfFilePackageLine returns the line of the file's package (or namespace) declaration if
+// scopeStart is where the root node's scope starts, and -1 otherwise. The root scope's header
+// begins at the first line of the file, which is often a license or doc comment rather than
+// the package line ShowTopOfFileParentScope is meant to reveal.
+func (tc *TreeContext) topOfFilePackageLine(scopeStart int) int {
+	if tc.root == nil || scopeStart != int(tc.root.StartPosition().Row) {
+		return -1
+	}
+	for i := uint(0); i < tc.root.NamedChildCount(); i++ {
+		child := tc.root.NamedChild(i)
+		if child == nil {
+			continue
+		}
+		if _, ok := packageKinds[child.Kind()]; ok {
+			return int(child.StartPosition().Row)
+		}
+	}
+	return -1
+}
+
+// annotationKinds are the node kinds of decorators and annotations attached to a declaration.
+var annotationKinds = map[string]struct{}{
+	"decorator":         {}, // python, javascript, typescript
+	"annotation":        {}, // java
+	"marker_annotation": {}, // java
+	"attribute_list":    {}, // c_sharp
+	"attribute_item":    {}, // rust
+}
+
+// addAnnotations shows the decorator and annotation lines directly above line i, which may
+// span several lines each, and returns the first line shown (i if there are none).
+func (tc *TreeContext) addAnnotations(i int) int {
+	first := i
+	for ln := i - 1; ln >= 0 && ln < len(tc.lineStarts); {
+		line := tc.line(ln)
+		col := len(line) - len(bytes.TrimLeft(line, " \t"))
+		node := tc.NodeAt(ln, col)
+		for node != nil {
+			if _, ok := annotationKinds[node.Kind()]; ok {
+				break
+			}
+			node = node.Parent()
+		}
+		if node == nil || int(node.EndPosition().Row) != ln {
+			break
+		}
+		start := int(node.StartPosition().Row)
+		for a := start; a <= ln; a++ {
+			tc.showLines[a] = struct{}{}
+		}
+		first = start
+		ln = start - 1
+	}
+	return first
+}
+
+// addLeadingComments shows the contiguous own-line comments directly above line i,
+// stopping at the first blank or non-comment line.
+func (tc *TreeContext) addLeadingComments(i int) {
+	for ln := i - 1; ln >= 0; {
+		start, ok := tc.comments[ln]
+		if !ok {
+			return
+		}
+		for c := start; c <= ln; c++ {
+			tc.showLines[c] = struct{}{}
+		}
+		ln = start - 1
+	}
+}
+
+// indexScopes flattens scopeEnd into scopeStarts and scopeIndex, sweeping the lines once
+// and keeping the scopes still open at each line.
+func (tc *TreeContext) indexScopes() {
+	n := len(tc.scopeEnd)
+	tc.scopeIndex = make([]int, n+1)
+	var starts, open []int
+	for i := 0; i < n; i++ {
+		if tc.scopeEnd[i] >= i {
+			open = append(open, i)
+		}
+		stillOpen := open[:0]
+		for _, start := range open {
+			if tc.scopeEnd[start] >= i {
+				stillOpen = append(stillOpen, start)
+			}
+		}
+		open = stillOpen
+		tc.scopeIndex[i] = len(starts)
+		starts = append(starts, open...)
+	}
+	tc.scopeIndex[n] = len(starts)
+	tc.scopeStarts = starts
+}
+
+// scopesOf returns the start lines of the scopes covering line i in ascending order, sharing
+// scopeStarts' memory; nil if i is out of range.
+func (tc *TreeContext) scopesOf(i int) []int {
+	if i < 0 || i+1 >= len(tc.scopeIndex) {
+		return nil
+	}
+	return tc.scopeStarts[tc.scopeIndex[i]:tc.scopeIndex[i+1]]
+}
+
 // walkTree populates scopes, headers, etc.
 func (tc *TreeContext) walkTree(node *sitter.Node, depth int) (int, int) {
 	startLine := int(node.StartPosition().Row)
@@ -491,8 +2360,34 @@ func (tc *TreeContext) walkTree(node *sitter.Node, depth int) (int, int) {
 	if startLine < 0 || startLine >= len(tc.nodes) {
 		return startLine, endLine
 	}
+	if tc.maxDepth > 0 && depth > tc.maxDepth {
+		// too deep; leave this subtree unindexed
+		return startLine, endLine
+	}
+	if tc.skipErrorNodes && (node.IsError() || node.IsMissing()) {
+		// don't let a syntax error become a scope, but keep the valid code inside it
+		for i := uint(0); i < tc.childCount(node); i++ {
+			if child := tc.child(node, i); child != nil {
+				tc.walkTree(child, depth+1)
+			}
+		}
+		return startLine, endLine
+	}
 	tc.nodes[startLine] = append(tc.nodes[startLine], node)
 
+	// Remember comments that start their line, for IncludeLeadingComments
+	if strings.Contains(node.Kind(), "comment") && startLine < len(tc.lineStarts) {
+		line := tc.line(startLine)
+		if int(node.StartPosition().Column) == len(line)-len(bytes.TrimLeft(line, " \t")) {
+			commentEnd := endLine
+			if node.EndPosition().Column == 0 && commentEnd > startLine {
+				// some grammars include the trailing newline in line comments
+				commentEnd--
+			}
+			tc.comments[commentEnd] = startLine
+		}
+	}
+
 	// if tc.verbose && node.IsNamed() {
 	// 	textLine := strings.Split(node.Utf8Text(tc.source), "\n")[0]
 	// 	var codeLine string
@@ -518,12 +2413,12 @@ func (tc *TreeContext) walkTree(node *sitter.Node, depth int) (int, int) {
 	}
 
 	// Mark each line in [startLine, endLine] as belonging to scope `startLine`
-	for i := startLine; i <= endLine && i < len(tc.scopes); i++ {
-		tc.scopes[i][startLine] = struct{}{}
+	if startLine < len(tc.scopeEnd) {
+		tc.scopeEnd[startLine] = max(tc.scopeEnd[startLine], endLine)
 	}
 
-	for i := uint(0); i < node.ChildCount(); i++ {
-		if child := node.NamedChild(i); child != nil {
+	for i := uint(0); i < tc.childCount(node); i++ {
+		if child := tc.child(node, i); child != nil {
 			tc.walkTree(child, depth+1)
 		}
 	}
@@ -531,23 +2426,113 @@ func (tc *TreeContext) walkTree(node *sitter.Node, depth int) (int, int) {
 	return startLine, endLine
 }
 
+// childCount returns the number of children walkTree and findAllChildren descend into:
+// all of them with IncludeUnnamedNodes, otherwise only the named ones.
+func (tc *TreeContext) childCount(node *sitter.Node) uint {
+	if tc.unnamedNodes {
+		return node.ChildCount()
+	}
+	return node.NamedChildCount()
+}
+
+// child returns the i-th child counted by childCount.
+func (tc *TreeContext) child(node *sitter.Node, i uint) *sitter.Node {
+	if tc.unnamedNodes {
+		return node.Child(i)
+	}
+	return node.NamedChild(i)
+}
+
 // --- Helper functions ---
 
+// addedLines returns the lines in after that aren't in before.
+func addedLines(before, after map[int]struct{}) map[int]struct{} {
+	out := make(map[int]struct{})
+	for line := range after {
+		if _, ok := before[line]; !ok {
+			out[line] = struct{}{}
+		}
+	}
+	return out
+}
+
+// copyLineSet returns a copy of a set of line numbers.
+func copyLineSet(m map[int]struct{}) map[int]struct{} {
+	out := make(map[int]struct{}, len(m))
+	for k := range m {
+		out[k] = struct{}{}
+	}
+	return out
+}
+
 // mapKeysSorted returns sorted keys of a map[int]struct{} as a slice.
 func mapKeysSorted(m map[int]struct{}) []int {
 	out := make([]int, 0, len(m))
 	for k := range m {
 		out = append(out, k)
 	}
-	// a trivial sort
-	for i := 0; i < len(out); i++ {
-		for j := i + 1; j < len(out); j++ {
-			if out[j] < out[i] {
-				out[i], out[j] = out[j], out[i]
-			}
+	sort.Ints(out)
+	return out
+}
+
+// lineStartOffsets returns the byte offset at which each "\n"-separated line of source begins.
+func lineStartOffsets(source []byte) []int {
+	out := make([]int, 1, bytes.Count(source, []byte("\n"))+1)
+	for offset := 0; ; {
+		i := bytes.IndexByte(source[offset:], '\n')
+		if i < 0 {
+			return out
 		}
+		offset += i + 1
+		out = append(out, offset)
 	}
-	return out
+}
+
+// line returns the 0-based line i without its "\n", sharing source's memory.
+func (tc *TreeContext) line(i int) []byte {
+	end := len(tc.source)
+	if i+1 < len(tc.lineStarts) {
+		end = tc.lineStarts[i+1] - 1
+	}
+	return tc.source[tc.lineStarts[i]:end:end]
+}
+
+// countingWriter counts bytes written and remembers the first error, after which
+// writes are dropped, so formatting code can write unconditionally.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// estimateTokens approximates the LLM token count of s (roughly four characters per token).
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// distanceToNearest returns the distance from line to the closest entry in sorted.
+func distanceToNearest(line int, sorted []int) int {
+	best := -1
+	for _, other := range sorted {
+		d := line - other
+		if d < 0 {
+			d = -d
+		}
+		if best < 0 || d < best {
+			best = d
+		}
+	}
+	return best
 }
 
 // sortNodesBySize sorts nodes by (EndLine-StartLine) descending.
@@ -1,11 +1,16 @@
 package grepast
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	sitter "github.com/tree-sitter/go-tree-sitter"
 )
 
 func TestAddLinesOfInterest(t *testing.T) {
@@ -26,6 +31,7 @@ func TestAddLinesOfInterest(t *testing.T) {
 }
 
 func TestAddContext(t *testing.T) {
+	source := []byte(strings.Repeat("\n", 48) + "}") // 49 lines without a trailing newline
 	tc := &TreeContext{
 		linesOfInterest: map[int]struct{}{
 			10: {}, 20: {}, 30: {},
@@ -33,18 +39,21 @@ func TestAddContext(t *testing.T) {
 		showLines:        make(map[int]struct{}),
 		loiPad:           2,
 		margin:           1,
+		source:           source,
+		lineStarts:       lineStartOffsets(source),
 		numLines:         50,
 		lastLine:         true,
 		parentContext:    true,
 		childContext:     true,
-		scopes:           make([]map[int]struct{}, 50),
+		scopeEnd:         make([]int, 50),
 		doneParentScopes: make(map[int]struct{}),
 	}
 
-	// Initialize dummy scope data
-	for i := range tc.scopes {
-		tc.scopes[i] = make(map[int]struct{})
+	// Initialize dummy scope data: no line starts a scope
+	for i := range tc.scopeEnd {
+		tc.scopeEnd[i] = -1
 	}
+	tc.indexScopes()
 
 	tc.AddContext()
 
@@ -72,6 +81,2760 @@ func TestAddContext(t *testing.T) {
 	// (dependent on `addParentScopes` logic, can mock if needed)
 }
 
+func TestParseSourceNilTree(t *testing.T) {
+	// A parser without a language makes tree-sitter return a nil tree,
+	// which is the same failure mode as an ABI-incompatible grammar.
+	parser := sitter.NewParser()
+	defer parser.Close()
+
+	tree, root, err := parseSource(parser, []byte("package main\n"), nil)
+	assert.ErrorIs(t, err, ErrorParseFailed)
+	assert.Nil(t, tree)
+	assert.Nil(t, root)
+}
+
+func TestBlankSource(t *testing.T) {
+	options := TreeContextOptions{
+		ShowLineNumber:         true,
+		ShowParentContext:      true,
+		ShowChildContext:       true,
+		ShowLastLine:           true,
+		MarginPadding:          3,
+		HeaderMax:              10,
+		LinesOfInterestPadding: 2,
+	}
+
+	tests := []struct {
+		name     string
+		source   string
+		pattern  string
+		expected map[int]struct{}
+	}{
+		{name: "Zero-byte file", source: "", pattern: ".*", expected: map[int]struct{}{}},
+		{name: "Only newlines", source: "\n\n\n", pattern: "^", expected: map[int]struct{}{}},
+		{name: "Only whitespace", source: "  \t\n  \n", pattern: "\\s", expected: map[int]struct{}{}},
+		{name: "Single line without newline", source: "package main", pattern: "main", expected: map[int]struct{}{0: {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext("example.go", []byte(tt.source), options)
+			assert.NoError(t, err)
+
+			found := tc.Grep(tt.pattern, false)
+			assert.Equal(t, tt.expected, found)
+
+			tc.AddLinesOfInterest(found)
+			tc.AddContext()
+			out := tc.Format()
+
+			if len(tt.expected) == 0 {
+				assert.Equal(t, "", out)
+			} else {
+				assert.Contains(t, out, tt.source)
+			}
+		})
+	}
+}
+
+func TestBinaryFile(t *testing.T) {
+	// A PNG header renamed to .go
+	source := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x10")
+
+	_, err := NewTreeContext("image.go", source, TreeContextOptions{})
+	assert.ErrorIs(t, err, ErrorBinaryFile)
+
+	tc, err := NewTreeContext("image.go", source, TreeContextOptions{AllowBinary: true})
+	assert.NoError(t, err)
+	assert.NotNil(t, tc)
+}
+
+func TestStripBOM(t *testing.T) {
+	source := append([]byte{0xEF, 0xBB, 0xBF}, []byte("package main\n\nfunc main() {\n}\n")...)
+
+	tc, err := NewTreeContext("example.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "package main", tc.OriginalLine(0))
+
+	found := tc.Grep("^package", false)
+	assert.Equal(t, map[int]struct{}{0: {}}, found)
+}
+
+func TestNewTreeContextSentinelErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		expected error
+	}{
+		{name: "Unknown extension", filename: "notes.xyz", expected: ErrorUnrecognizedFiletype},
+		{name: "Known but unsupported language", filename: "lib.c", expected: ErrorUnsupportedLanguage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTreeContext(tt.filename, []byte("x"), TreeContextOptions{})
+			assert.True(t, errors.Is(err, tt.expected), "expected %v, got %v", tt.expected, err)
+			assert.Contains(t, err.Error(), tt.filename)
+		})
+	}
+}
+
+func TestDetectLanguageFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		source   string
+		want     string
+	}{
+		{name: "Go source with a .txt name", filename: "snippet.txt", source: "// Package x.\npackage x\n\nfunc f() {}\n", want: "go"},
+		{name: "shell script without extension", filename: "bin/deploy", source: "#!/usr/bin/env bash\necho hi\n", want: "bash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext(tt.filename, []byte(tt.source), TreeContextOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tc.language)
+			assert.NotNil(t, tc.RootNode())
+			assert.False(t, tc.HasParseErrors())
+		})
+	}
+
+	// a recognized extension without a grammar isn't sniffed
+	_, err := NewTreeContext("lib.c", []byte("package main\n"), TreeContextOptions{})
+	assert.ErrorIs(t, err, ErrorUnsupportedLanguage)
+
+	// the parser doesn't cache a content-based guess for an unknown extension
+	p := NewParser()
+	defer p.Close()
+	_, err = p.Parse("a.txt", []byte("package a\n"), TreeContextOptions{})
+	assert.NoError(t, err)
+	_, err = p.Parse("b.txt", []byte("just some notes\n"), TreeContextOptions{})
+	assert.ErrorIs(t, err, ErrorUnrecognizedFiletype)
+}
+
+func TestTypeScriptDialects(t *testing.T) {
+	// The TSX grammar accepts JSX elements, the plain TypeScript grammar does not.
+	source := []byte("const App = () => <div className=\"app\">hello</div>;\n")
+
+	tc, err := NewTreeContext("app.tsx", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	assert.False(t, tc.nodes[0][0].HasError(), "TSX source should parse cleanly with the TSX grammar")
+
+	tc, err = NewTreeContext("app.ts", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	assert.True(t, tc.nodes[0][0].HasError(), "JSX should not parse with the plain TypeScript grammar")
+}
+
+func TestPythonParentContext(t *testing.T) {
+	sourceCode := []byte(`import os
+
+
+class Greeter:
+    """Says hello."""
+
+    def __init__(self, name):
+        self.name = name
+
+    def greet(self):
+        # line 1
+        # line 2
+        # line 3
+        message = "hello " + self.name
+        # line 4
+        # line 5
+        # line 6
+        return message
+
+
+def main():
+    print(Greeter(os.getlogin()).greet())
+`)
+
+	tc, err := NewTreeContext("greeter.py", sourceCode, TreeContextOptions{
+		ShowParentContext: true,
+		HeaderMax:         10,
+	})
+	assert.NoError(t, err)
+
+	tc.AddLinesOfInterest(tc.Grep(`message = `, false))
+	tc.AddContext()
+	out := tc.Format()
+
+	assert.Contains(t, out, "class Greeter:", "Should show the enclosing class header")
+	assert.Contains(t, out, "def greet(self):", "Should show the enclosing def header")
+	assert.Contains(t, out, `message = "hello "`, "Should show the line of interest")
+	assert.NotContains(t, out, "def main():", "Should not show unrelated scopes")
+}
+
+func TestRustImplParentContext(t *testing.T) {
+	sourceCode := []byte(`use std::fmt;
+
+pub struct Counter {
+    count: u32,
+}
+
+impl Counter {
+    pub fn new() -> Self {
+        Counter { count: 0 }
+    }
+
+    pub fn increment(&mut self) -> u32 {
+        // line 1
+        // line 2
+        // line 3
+        self.count += 1;
+        // line 4
+        // line 5
+        // line 6
+        self.count
+    }
+}
+`)
+
+	tc, err := NewTreeContext("counter.rs", sourceCode, TreeContextOptions{
+		ShowParentContext: true,
+		ShowChildContext:  true,
+		HeaderMax:         1,
+	})
+	assert.NoError(t, err)
+
+	tc.AddLinesOfInterest(tc.Grep(`self\.count \+= 1`, false))
+	tc.AddContext()
+	out := tc.Format()
+
+	assert.Contains(t, out, "impl Counter {", "Should show the enclosing impl header")
+	assert.Contains(t, out, "pub fn increment(&mut self) -> u32 {", "Should show the enclosing fn header")
+	assert.NotContains(t, out, "pub fn new() -> Self {", "Should not show sibling fn headers")
+	assert.NotContains(t, out, "pub struct Counter {", "Should not show unrelated scopes")
+}
+
+func TestJavaMultilineSignatureHeader(t *testing.T) {
+	sourceCode := []byte(`public class Greeter {
+    public String greet(
+            String name,
+            String greeting,
+            String punctuation,
+            int repeat,
+            boolean shout) {
+        // line 1
+        // line 2
+        // line 3
+        String message = greeting + " " + name;
+        // line 4
+        // line 5
+        // line 6
+        return shout ? message.toUpperCase() : message;
+    }
+}
+`)
+
+	tests := []struct {
+		name      string
+		headerMax int
+		shown     []string
+		hidden    []string
+	}{
+		{
+			name:      "Truncated to one line",
+			headerMax: 1,
+			shown:     []string{"public String greet("},
+			hidden:    []string{"String name,", "String greeting,", "String punctuation,", "int repeat,"},
+		},
+		{
+			name:      "Truncated to two lines",
+			headerMax: 2,
+			shown:     []string{"public String greet(", "String name,"},
+			hidden:    []string{"String greeting,", "String punctuation,", "int repeat,"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext("Greeter.java", sourceCode, TreeContextOptions{
+				ShowParentContext:        true,
+				ShowTopOfFileParentScope: true,
+				HeaderMax:                tt.headerMax,
+			})
+			assert.NoError(t, err)
+
+			tc.AddLinesOfInterest(tc.Grep(`String message`, false))
+			tc.AddContext()
+			out := tc.Format()
+
+			assert.Contains(t, out, "public class Greeter {")
+			for _, line := range tt.shown {
+				assert.Contains(t, out, line)
+			}
+			for _, line := range tt.hidden {
+				assert.NotContains(t, out, line)
+			}
+		})
+	}
+
+	// The method body must still be recognized as one scope ending at its closing brace.
+	tc, err := NewTreeContext("Greeter.java", sourceCode, TreeContextOptions{HeaderMax: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 15, tc.getLastLineOfScope(1))
+}
+
+func TestLanguageOverride(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n}\n")
+
+	// An unknown extension is rescued by the override.
+	tc, err := NewTreeContext("main.txt", source, TreeContextOptions{Language: "go"})
+	assert.NoError(t, err)
+	assert.Equal(t, "source_file", tc.nodes[0][0].Kind())
+
+	// An unknown override is reported as unsupported.
+	_, err = NewTreeContext("main.go", source, TreeContextOptions{Language: "cobol"})
+	assert.ErrorIs(t, err, ErrorUnsupportedLanguage)
+}
+
+func TestFormatWithinBudget(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("package main\n\nimport \"fmt\"\n\nfunc largeScope() {\n")
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&sb, "\tfmt.Println(\"filler line %d\")\n", i)
+	}
+	sb.WriteString("\tfmt.Println(\"needle\")\n")
+	for i := 40; i < 80; i++ {
+		fmt.Fprintf(&sb, "\tfmt.Println(\"filler line %d\")\n", i)
+	}
+	sb.WriteString("}\n")
+
+	options := TreeContextOptions{
+		ShowLineNumber:         true,
+		ShowParentContext:      true,
+		ShowChildContext:       true,
+		MarginPadding:          3,
+		HeaderMax:              10,
+		LinesOfInterestPadding: 5,
+	}
+
+	unbounded, err := NewTreeContext("example.go", []byte(sb.String()), options)
+	assert.NoError(t, err)
+	unbounded.AddLinesOfInterest(unbounded.Grep("needle", false))
+	unbounded.AddContext()
+	full := unbounded.FormatWithinBudget()
+
+	options.MaxOutputTokens = 120
+	tc, err := NewTreeContext("example.go", []byte(sb.String()), options)
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+	tc.AddContext()
+	shown := tc.ShowLines()
+	out := tc.FormatWithinBudget()
+
+	assert.Equal(t, unbounded.Format(), full, "No budget should not trim anything")
+	assert.Less(t, len(out), len(full), "Output should shrink under a tight budget")
+	assert.LessOrEqual(t, estimateTokens(out), options.MaxOutputTokens)
+	assert.Contains(t, out, `fmt.Println("needle")`, "Line of interest must be kept")
+	assert.Contains(t, out, "func largeScope() {", "Parent header must be kept")
+	assert.Contains(t, out, "package main", "Child context is dropped before the top margin")
+	assert.Equal(t, shown, tc.ShowLines(), "Formatting must not change the selection")
+	assert.Equal(t, unbounded.Format(), tc.Format())
+}
+
+func TestCaretUnderline(t *testing.T) {
+	sourceCode := []byte(`package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("needle in a haystack, needle")
+}
+`)
+
+	tc, err := NewTreeContext("example.go", sourceCode, TreeContextOptions{
+		ShowLineNumber:      true,
+		MarkLinesOfInterest: true,
+		ShowCaretUnderline:  true,
+	})
+	assert.NoError(t, err)
+
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+	tc.AddContext()
+	out := strings.Split(tc.Format(), "\n")
+
+	// Find the matched line and check the carets sit directly underneath each match.
+	idx := -1
+	for i, line := range out {
+		if strings.Contains(line, "needle in a haystack") {
+			idx = i
+		}
+	}
+	assert.GreaterOrEqual(t, idx, 0, "matched line should be shown")
+	matched, caret := []rune(out[idx]), []rune(out[idx+1])
+
+	assert.Equal(t, "  6█", string(matched[:4]))
+	assert.Equal(t, "   │", string(caret[:4]))
+	var want, got []int
+	for i := 0; i+len("needle") <= len(matched); i++ {
+		if string(matched[i:i+len("needle")]) == "needle" {
+			for j := i; j < i+len("needle"); j++ {
+				want = append(want, j)
+			}
+		}
+	}
+	for i, r := range caret {
+		if r == '^' {
+			got = append(got, i)
+		}
+	}
+	assert.Equal(t, want, got, "carets should line up under the matched columns")
+}
+
+func TestCaretUnderlineWideRunes(t *testing.T) {
+	sourceCode := []byte("package main\n\nfunc main() {\n\t名前 := needle(\"日本\")\n}\n")
+
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		// 名 and 前 are two columns wide each, as are the runes of the "日本" match
+		{pattern: "needle", want: "   │\t        ^^^^^^"},
+		{pattern: "日本", want: "   │\t                ^^^^"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			tc, err := NewTreeContext("example.go", sourceCode, TreeContextOptions{
+				ShowLineNumber:     true,
+				ShowCaretUnderline: true,
+			})
+			assert.NoError(t, err)
+			tc.AddLinesOfInterest(tc.Grep(tt.pattern, false))
+			tc.AddContext()
+
+			out := strings.Split(tc.Format(), "\n")
+			idx := -1
+			for i, line := range out {
+				if strings.Contains(line, "名前 := needle") {
+					idx = i
+				}
+			}
+			assert.GreaterOrEqual(t, idx, 0, "matched line should be shown")
+			assert.Equal(t, tt.want, out[idx+1])
+		})
+	}
+}
+
+func TestShowScopeClosers(t *testing.T) {
+	sourceCode := []byte(`package main
+
+import "fmt"
+
+func largeScope() {
+	// line 1
+	// line 2
+	// line 3
+	fmt.Println("needle")
+	// line 4
+	// line 5
+	// line 6
+}
+
+func main() {
+	largeScope()
+}
+`)
+
+	for _, closers := range []bool{false, true} {
+		tc, err := NewTreeContext("example.go", sourceCode, TreeContextOptions{
+			ShowLineNumber:    true,
+			ShowParentContext: true,
+			ShowScopeClosers:  closers,
+			HeaderMax:         10,
+		})
+		assert.NoError(t, err)
+
+		tc.AddLinesOfInterest(tc.Grep("needle", false))
+		tc.AddContext()
+		out := tc.Format()
+
+		assert.Contains(t, out, "  5│func largeScope() {")
+		if closers {
+			assert.Contains(t, out, " 13│}", "Closing brace of the enclosing function should be shown")
+		} else {
+			assert.NotContains(t, out, " 13│}")
+		}
+	}
+}
+
+func TestIncludeLeadingComments(t *testing.T) {
+	sourceCode := []byte(`package main
+
+import "fmt"
+
+// unrelated comment
+
+// largeScope prints a pin
+// surrounded by filler.
+func largeScope() {
+	x := 1 // trailing comment
+	// line 2
+	// line 3
+	fmt.Println("needle", x)
+	// line 4
+	// line 5
+	// line 6
+}
+`)
+
+	for _, comments := range []bool{false, true} {
+		tc, err := NewTreeContext("example.go", sourceCode, TreeContextOptions{
+			ShowParentContext:      true,
+			IncludeLeadingComments: comments,
+			HeaderMax:              1,
+		})
+		assert.NoError(t, err)
+
+		tc.AddLinesOfInterest(tc.Grep("needle", false))
+		tc.AddContext()
+		out := tc.Format()
+
+		assert.Contains(t, out, "func largeScope() {")
+		assert.NotContains(t, out, "unrelated comment", "Should stop at the blank line")
+		if comments {
+			assert.Contains(t, out, "// largeScope prints a pin")
+			assert.Contains(t, out, "// surrounded by filler.")
+		} else {
+			assert.NotContains(t, out, "// largeScope prints a pin")
+		}
+	}
+}
+
+func TestShowImports(t *testing.T) {
+	sourceCode := []byte(`package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func helper() string {
+	return strings.ToUpper("x")
+}
+
+func largeScope() {
+	// line 1
+	// line 2
+	// line 3
+	fmt.Println("needle", helper())
+}
+`)
+
+	for _, imports := range []bool{false, true} {
+		tc, err := NewTreeContext("example.go", sourceCode, TreeContextOptions{
+			ShowLineNumber: true,
+			ShowImports:    imports,
+		})
+		assert.NoError(t, err)
+
+		tc.AddLinesOfInterest(tc.Grep("needle", false))
+		tc.AddContext()
+		out := tc.Format()
+
+		assert.Contains(t, out, `fmt.Println("needle", helper())`)
+		for _, line := range []string{"  1│package main", "  3│import (", `  4│	"fmt"`, `  5│	"strings"`, "  6│)"} {
+			if imports {
+				assert.Contains(t, out, line)
+			} else {
+				assert.NotContains(t, out, line)
+			}
+		}
+		assert.NotContains(t, out, "func helper() string {")
+	}
+}
+
+func TestSExpression(t *testing.T) {
+	tc, err := NewTreeContext("example.go", []byte("package main\n\nfunc main() {}\n"), TreeContextOptions{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "source_file", tc.RootNode().Kind())
+	sexp := tc.SExpression()
+	assert.True(t, strings.HasPrefix(sexp, "(source_file"), "unexpected S-expression: %s", sexp)
+	assert.Contains(t, sexp, "(function_declaration")
+
+	tc.Close()
+	assert.Nil(t, tc.RootNode())
+	assert.Equal(t, "", tc.SExpression())
+	tc.Close() // closing twice is harmless
+}
+
+func TestWalk(t *testing.T) {
+	sourceCode := []byte(`package main
+
+type T struct{}
+
+func (T) method() {}
+
+func one() {
+	inner := func() {}
+	inner()
+}
+
+func two() {}
+`)
+
+	tc, err := NewTreeContext("example.go", sourceCode, TreeContextOptions{})
+	assert.NoError(t, err)
+
+	// Count every function-like node.
+	var funcs int
+	tc.Walk(func(node *sitter.Node, depth int) bool {
+		switch node.Kind() {
+		case "function_declaration", "method_declaration", "func_literal":
+			funcs++
+		}
+		return true
+	})
+	assert.Equal(t, 4, funcs)
+
+	// Returning false stops descent: only top-level declarations are seen.
+	var topLevel []string
+	tc.Walk(func(node *sitter.Node, depth int) bool {
+		if depth == 1 {
+			topLevel = append(topLevel, node.Kind())
+		}
+		return depth < 1
+	})
+	assert.Equal(t, []string{"package_clause", "type_declaration", "method_declaration", "function_declaration", "function_declaration"}, topLevel)
+}
+
+func TestNodeAt(t *testing.T) {
+	sourceCode := []byte(`package main
+
+func main() {
+	greeting := "héllo"
+	println(greeting)
+}
+`)
+
+	tc, err := NewTreeContext("example.go", sourceCode, TreeContextOptions{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		line     int
+		col      int
+		expected string
+	}{
+		{name: "Inside identifier", line: 4, col: 12, expected: "identifier"},
+		{name: "Function name", line: 2, col: 6, expected: "identifier"},
+		{name: "Inside string after multibyte rune", line: 3, col: 18, expected: "interpreted_string_literal_content"},
+		{name: "Package clause keyword", line: 0, col: 2, expected: "package_clause"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := tc.NodeAt(tt.line, tt.col)
+			if assert.NotNil(t, node) {
+				assert.Equal(t, tt.expected, node.Kind())
+			}
+		})
+	}
+
+	assert.Nil(t, tc.NodeAt(-1, 0))
+	assert.Nil(t, tc.NodeAt(100, 0))
+	assert.Nil(t, tc.NodeAt(0, 100))
+}
+
+func TestMaxDepth(t *testing.T) {
+	const nesting = 5000
+	source := []byte("package main\n\nvar x = " + strings.Repeat("(", nesting) + "1" + strings.Repeat(")", nesting) + "\n")
+
+	countNodes := func(tc *TreeContext) int {
+		var n int
+		for _, nodes := range tc.nodes {
+			n += len(nodes)
+		}
+		return n
+	}
+
+	unlimited, err := NewTreeContext("deep.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+
+	limited, err := NewTreeContext("deep.go", source, TreeContextOptions{MaxDepth: 10})
+	assert.NoError(t, err)
+
+	assert.Greater(t, countNodes(unlimited), nesting)
+	assert.Less(t, countNodes(limited), 20, "nodes below MaxDepth should not be indexed")
+
+	// The explicit-stack child gathering copes with the full depth.
+	children := limited.findAllChildren(limited.RootNode())
+	assert.Greater(t, len(children), nesting)
+
+	limited.AddLinesOfInterest(limited.Grep("var x", false))
+	limited.AddContext()
+	assert.Contains(t, limited.Format(), "var x = ((")
+}
+
+func TestGrepErr(t *testing.T) {
+	tc, err := NewTreeContext("example.go", []byte("package main\n"), TreeContextOptions{})
+	assert.NoError(t, err)
+
+	found, err := tc.GrepErr("pack(", false)
+	assert.Error(t, err)
+	assert.Nil(t, found)
+
+	found, err = tc.GrepErr("PACKAGE", true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]struct{}{0: {}}, found)
+
+	assert.Panics(t, func() { tc.Grep("pack(", false) })
+}
+
+func TestGetLastLineOfScopeMemoized(t *testing.T) {
+	tc, err := NewTreeContext("example.go", largeGoSource(3), TreeContextOptions{})
+	assert.NoError(t, err)
+
+	// Reference implementation without memoization.
+	expected := func(i int) int {
+		if i < 0 || i >= len(tc.nodes) || len(tc.nodes[i]) == 0 {
+			return i
+		}
+		lastLine := 0
+		for _, node := range tc.nodes[i] {
+			if int(node.EndPosition().Row) > lastLine {
+				lastLine = int(node.EndPosition().Row)
+			}
+		}
+		return lastLine
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		for i := -1; i <= len(tc.nodes); i++ {
+			assert.Equal(t, expected(i), tc.getLastLineOfScope(i), "line %d, pass %d", i, pass)
+		}
+	}
+}
+
+func TestFormatEllipsisPlacement(t *testing.T) {
+	source := []byte("l0\nl1\nl2\nl3\nl4\nl5\nl6\nl7\n")
+	tc, err := NewTreeContext("example.go", source, TreeContextOptions{ShowLineNumber: true})
+	assert.NoError(t, err)
+
+	// Reference: scan every source line, emitting one ellipsis per run of hidden lines.
+	// The empty element after the trailing newline isn't a line of the file.
+	scan := func() string {
+		var sb strings.Builder
+		_, firstLineShown := tc.showLines[0]
+		printEllipsis := !firstLineShown
+		for i, line := range tc.Lines() {
+			if _, ok := tc.showLines[i]; !ok {
+				if printEllipsis {
+					sb.WriteString("⋮...\n")
+					printEllipsis = false
+				}
+				continue
+			}
+			fmt.Fprintf(&sb, "%3d%s%s\n", i+1, tc.lineOfInterestSpacer(i), line)
+			printEllipsis = true
+		}
+		return sb.String()
+	}
+
+	tests := [][]int{
+		{0},
+		{8},
+		{0, 8},
+		{3},
+		{0, 1, 2},
+		{2, 3, 6},
+		{1, 3, 5, 7},
+		{0, 1, 2, 3, 4, 5, 6, 7, 8},
+		{-1, 42},
+	}
+	for _, lines := range tests {
+		tc.showLines = make(map[int]struct{})
+		for _, ln := range lines {
+			tc.showLines[ln] = struct{}{}
+		}
+		tc.invalidateShown()
+		assert.Equal(t, scan(), tc.Format(), "showLines %v", lines)
+	}
+}
+
+func TestSortedShowLinesInvalidation(t *testing.T) {
+	source := []byte("package main\n\nfunc a() {}\n\nfunc b() {}\n")
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	tc.AddLineOfInterest(2)
+	tc.AddContext()
+	assert.Equal(t, []int{2, 3}, tc.sortedShowLines())
+
+	// swapping one shown line for another keeps the count but not the lines
+	delete(tc.showLines, 2)
+	tc.showLines[4] = struct{}{}
+	tc.invalidateShown()
+	assert.Equal(t, []int{3, 4}, tc.sortedShowLines())
+	assert.Equal(t, "⋮...\n│\n│func b() {}\n", tc.Format())
+}
+
+// failingWriter fails every write after the first limit bytes.
+type failingWriter struct {
+	limit int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.limit {
+		n := fw.limit
+		fw.limit = 0
+		return n, io.ErrShortWrite
+	}
+	fw.limit -= len(p)
+	return len(p), nil
+}
+
+func TestFormatTo(t *testing.T) {
+	tc, err := NewTreeContext("example.go", largeGoSource(200), TreeContextOptions{
+		Color:             true,
+		ShowLineNumber:    true,
+		ShowParentContext: true,
+		HeaderMax:         10,
+	})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep(`Println\(1\d\)`, false))
+	tc.AddContext()
+	expected := tc.Format()
+
+	var buf bytes.Buffer
+	assert.NoError(t, tc.FormatTo(&buf))
+	assert.Equal(t, expected, buf.String())
+
+	// An unbuffered writer goes through bufio and is flushed.
+	var file strings.Builder
+	assert.NoError(t, tc.FormatTo(struct{ io.Writer }{&file}))
+	assert.Equal(t, expected, file.String())
+
+	assert.ErrorIs(t, tc.FormatTo(&failingWriter{limit: 10}), io.ErrShortWrite)
+}
+
+func TestWriteTo(t *testing.T) {
+	tc, err := NewTreeContext("example.go", largeGoSource(20), TreeContextOptions{
+		ShowLineNumber:    true,
+		ShowParentContext: true,
+		HeaderMax:         10,
+	})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep(`Println\(1\d\)`, false))
+	tc.AddContext()
+	expected := tc.Format()
+
+	var _ io.WriterTo = tc
+
+	var buf bytes.Buffer
+	n, err := tc.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, buf.String())
+	assert.Equal(t, int64(len(expected)), n)
+
+	var file strings.Builder
+	n, err = tc.WriteTo(struct{ io.Writer }{&file})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, file.String())
+	assert.Equal(t, int64(len(expected)), n)
+}
+
+func TestString(t *testing.T) {
+	tc, err := NewTreeContext("example.go", largeGoSource(3), TreeContextOptions{ShowParentContext: true})
+	assert.NoError(t, err)
+
+	var _ fmt.Stringer = tc
+	assert.Equal(t, "", fmt.Sprint(tc), "nothing is selected yet")
+
+	tc.AddLinesOfInterest(tc.Grep(`Println\(1\)`, false))
+	tc.AddContext()
+	assert.NotEmpty(t, tc.Format())
+	assert.Equal(t, tc.Format(), fmt.Sprint(tc))
+}
+
+func TestSortedLineAccessors(t *testing.T) {
+	tc, err := NewTreeContext("example.go", largeGoSource(5), TreeContextOptions{ShowParentContext: true})
+	assert.NoError(t, err)
+
+	tc.AddLinesOfInterest(map[int]struct{}{17: {}, 5: {}, 9: {}})
+	tc.AddContext()
+
+	lois := tc.LinesOfInterest()
+	assert.Equal(t, []int{5, 9, 17}, lois)
+
+	shown := tc.ShowLines()
+	assert.True(t, sort.IntsAreSorted(shown))
+	assert.Len(t, shown, len(tc.showLines))
+
+	// Mutating the returned slices must not leak back into the context.
+	lois[0] = 100
+	shown[0] = -100
+	assert.Equal(t, []int{5, 9, 17}, tc.LinesOfInterest())
+	_, leaked := tc.showLines[-100]
+	assert.False(t, leaked)
+	assert.Equal(t, tc.ShowLines()[0], mapKeysSorted(tc.showLines)[0])
+}
+
+func TestScopeAndHeaderAccessors(t *testing.T) {
+	sourceCode := []byte(`package main
+
+func outer() {
+	if true {
+		println("x")
+	}
+}
+`)
+
+	tc, err := NewTreeContext("example.go", sourceCode, TreeContextOptions{HeaderMax: 10})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []int{0, 2, 3, 4}, tc.ScopeStarts(4), "println sits in the file, func, if and its own statement")
+	assert.Equal(t, []int{0, 2}, tc.ScopeStarts(6), "closing brace of outer")
+	assert.Equal(t, []int{}, tc.ScopeStarts(-1))
+	assert.Equal(t, []int{}, tc.ScopeStarts(1000))
+
+	start, end := tc.Header(2)
+	assert.Equal(t, 2, start)
+	assert.Equal(t, 6, end)
+
+	start, end = tc.Header(3)
+	assert.Equal(t, 3, start)
+	assert.Equal(t, 5, end)
+
+	start, end = tc.Header(1000)
+	assert.Equal(t, 0, start)
+	assert.Equal(t, 0, end)
+
+	// Returned scope slices are copies.
+	starts := tc.ScopeStarts(4)
+	starts[0] = 99
+	assert.Equal(t, []int{0, 2, 3, 4}, tc.ScopeStarts(4))
+
+	// outer's scope runs from its opening to its closing brace
+	lines := tc.ScopeLines(2)
+	assert.Equal(t, []int{2, 3, 4, 5, 6}, lines)
+	assert.True(t, strings.HasSuffix(tc.OriginalLine(lines[0]), "{"))
+	assert.Equal(t, "}", tc.OriginalLine(lines[len(lines)-1]))
+	assert.Equal(t, []int{3, 4, 5}, tc.ScopeLines(3))
+	assert.Equal(t, []int{4}, tc.ScopeLines(4), "a single-line statement")
+	assert.Equal(t, []int{}, tc.ScopeLines(1), "blank line")
+	assert.Equal(t, []int{}, tc.ScopeLines(1000))
+}
+
+func TestLinesAccessors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{name: "trailing newline", source: "package main\n\nfunc main() {}\n", want: []string{"package main", "", "func main() {}"}},
+		{name: "no trailing newline", source: "package main\n\nfunc main() {}", want: []string{"package main", "", "func main() {}"}},
+		{name: "trailing blank line", source: "package main\n\n", want: []string{"package main", ""}},
+		{name: "empty", source: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext("main.go", []byte(tt.source), TreeContextOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, len(tt.want), tc.NumLines())
+			lines := tc.Lines()
+			assert.Equal(t, tt.want, lines)
+			if len(lines) > 0 {
+				assert.Equal(t, "package main", lines[0])
+
+				// the slice is a copy
+				lines[0] = "changed"
+				assert.Equal(t, "package main", tc.Lines()[0])
+			}
+		})
+	}
+}
+
+func TestLineRangeFragments(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"needle\")\n}\n\nvar other = 1\n\nvar needle = 2\n")
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{ShowParentContext: true, HeaderMax: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, tc.LineRangeFragments())
+
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+	tc.AddContext()
+	assert.Equal(t, []string{"L3-L4", "L9"}, tc.LineRangeFragments())
+}
+
+func TestHighlightedLine(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"needle\")\n}\n")
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{Color: true})
+	assert.NoError(t, err)
+	tc.Grep("needle", false)
+
+	hl, ok := tc.HighlightedLine(3)
+	assert.True(t, ok)
+	assert.Contains(t, hl, "\033[1;31mneedle\033[0m")
+	assert.Equal(t, "\tprintln(\"needle\")", tc.OriginalLine(3))
+
+	hl, ok = tc.HighlightedLine(2)
+	assert.False(t, ok)
+	assert.Empty(t, hl)
+	assert.Equal(t, "func main() {", tc.OriginalLine(2))
+	assert.Empty(t, tc.OriginalLine(-1))
+	assert.Empty(t, tc.OriginalLine(5))
+}
+
+func TestNewTreeContextFromLines(t *testing.T) {
+	lines := []string{"package main", "", "func main() {", "\tif true {", "\t\tprintln(\"needle\")", "\t}", "}"}
+	opts := TreeContextOptions{ShowLineNumber: true, ShowParentContext: true, HeaderMax: 10, MarkLinesOfInterest: true}
+
+	format := func(tc *TreeContext) string {
+		tc.AddLinesOfInterest(tc.Grep("needle", false))
+		tc.AddContext()
+		return tc.Format()
+	}
+
+	for _, source := range []string{strings.Join(lines, "\n"), strings.Join(lines, "\n") + "\n"} {
+		want, err := NewTreeContext("main.go", []byte(source), opts)
+		assert.NoError(t, err)
+
+		got, err := NewTreeContextFromLines("main.go", lines, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, format(want), format(got))
+		assert.Equal(t, want.Symbols(), got.Symbols())
+	}
+
+	// the given slice isn't kept, so the caller may reuse it
+	tc, err := NewTreeContextFromLines("main.go", lines, opts)
+	assert.NoError(t, err)
+	lines[0] = "package other"
+	assert.Equal(t, "package main", tc.OriginalLine(0))
+
+	tc, err = NewTreeContextFromLines("main.go", nil, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tc.NumLines())
+}
+
+func TestFormatEach(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"needle\")\n}\n\nfunc other() {}\n")
+	opts := TreeContextOptions{ShowLineNumber: true, ShowParentContext: true, HeaderMax: 1, MarkLinesOfInterest: true, ShowCaretUnderline: true}
+	tc, err := NewTreeContext("main.go", source, opts)
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+	tc.AddContext()
+
+	type call struct {
+		lineNum    int
+		isLOI      bool
+		isEllipsis bool
+	}
+	var calls []call
+	var sb strings.Builder
+	tc.FormatEach(func(lineNum int, text string, isLOI, isEllipsis bool) bool {
+		calls = append(calls, call{lineNum, isLOI, isEllipsis})
+		sb.WriteString(text + "\n")
+		return true
+	})
+	assert.Equal(t, tc.Format(), sb.String())
+	assert.Equal(t, []call{
+		{1, false, true},
+		{3, false, false},
+		{4, true, false},
+		{4, true, false},
+		{5, false, true},
+	}, calls)
+
+	// returning false stops
+	n := 0
+	tc.FormatEach(func(lineNum int, text string, isLOI, isEllipsis bool) bool {
+		n++
+		return n < 2
+	})
+	assert.Equal(t, 2, n)
+}
+
+func TestMergeSelection(t *testing.T) {
+	source := []byte("package main\n\nfunc first() {\n\tprintln(\"alpha\")\n}\n\nfunc second() {\n\tprintln(\"beta\", \"alpha\")\n}\n")
+	opts := TreeContextOptions{Color: true, ShowParentContext: true, HeaderMax: 1, ShowLineNumber: true}
+
+	grep := func(pat string) *TreeContext {
+		tc, err := NewTreeContext("main.go", source, opts)
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep(pat, false))
+		tc.AddContext()
+		return tc
+	}
+
+	x, y := grep("alpha"), grep("beta")
+	assert.NoError(t, x.MergeSelection(y))
+	assert.Equal(t, []int{3, 7}, x.LinesOfInterest())
+	assert.Equal(t, []Match{{Line: 7, Start: 10, End: 14}, {Line: 7, Start: 18, End: 23}}, x.Matches(7))
+
+	both := grep("alpha|beta")
+	assert.Equal(t, both.Format(), x.Format())
+
+	// highlighting without match spans adds no spans
+	z := grep("alpha")
+	assert.NoError(t, z.HighlightMulti([]string{"func"}, []string{"32"}, false))
+	merged := grep("beta")
+	assert.NoError(t, merged.MergeSelection(z))
+	assert.Equal(t, []int{3, 7}, merged.MatchedLines())
+	assert.Contains(t, merged.outputLines[2], "\033[32mfunc\033[0m")
+
+	other, err := NewTreeContext("other.go", source, opts)
+	assert.NoError(t, err)
+	assert.Error(t, x.MergeSelection(other))
+
+	shorter, err := NewTreeContext("main.go", source[:20], opts)
+	assert.NoError(t, err)
+	assert.Error(t, x.MergeSelection(shorter))
+}
+
+func TestFormatMatchesOnly(t *testing.T) {
+	tc, err := NewTreeContext("example.go", largeGoSource(5), TreeContextOptions{
+		ShowLineNumber:         true,
+		ShowParentContext:      true,
+		ShowChildContext:       true,
+		MarginPadding:          3,
+		LinesOfInterestPadding: 2,
+		HeaderMax:              10,
+	})
+	assert.NoError(t, err)
+
+	tc.AddLinesOfInterest(tc.Grep(`Println\([13]\)`, false))
+	tc.AddContext()
+	out := tc.FormatMatchesOnly()
+
+	assert.Equal(t, "⋮...\n 10│\tfmt.Println(1)\n⋮...\n 18│\tfmt.Println(3)\n⋮...\n", out)
+}
+
+func TestAddDeclarationHeaders(t *testing.T) {
+	source := []byte(`package main
+
+import "regexp"
+
+// FileResult is one file's matches.
+type FileResult struct {
+	Path string
+}
+
+func GrepDirConcurrent(root, pattern string, workers int) ([]FileResult, error) {
+	re := regexp.MustCompile(pattern)
+	return grepFile(root, re), nil
+}
+
+func grepFile(root string, re *regexp.Regexp) []FileResult {
+	return nil
+}
+`)
+	tc, err := NewTreeContext("dir.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+
+	tc.AddDeclarationHeaders()
+	var outline []string
+	for _, line := range tc.LinesOfInterest() {
+		outline = append(outline, tc.OriginalLine(line))
+	}
+
+	assert.Equal(t, []string{
+		"type FileResult struct {",
+		"func GrepDirConcurrent(root, pattern string, workers int) ([]FileResult, error) {",
+		"func grepFile(root string, re *regexp.Regexp) []FileResult {",
+	}, outline)
+
+	tc.AddContext()
+	assert.Contains(t, tc.Format(), "func GrepDirConcurrent(")
+}
+
+func TestAddTopLevelStatements(t *testing.T) {
+	source := []byte(`package main
+
+import "fmt"
+
+// limit caps the output.
+const limit = 3
+
+type point struct {
+	x, y int
+}
+
+func main() {
+	fmt.Println(limit)
+}
+`)
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+
+	tc.AddTopLevelStatements()
+	assert.Equal(t, []int{0, 2, 5, 7, 11}, tc.LinesOfInterest())
+
+	script, err := NewTreeContext("run.sh", []byte("#!/bin/sh\nset -e\nif true; then\n  echo hi\nfi\necho done\n"), TreeContextOptions{})
+	assert.NoError(t, err)
+	script.AddTopLevelStatements()
+	assert.Equal(t, []int{1, 2, 5}, script.LinesOfInterest())
+}
+
+func TestFindNodesByKind(t *testing.T) {
+	tc, err := NewTreeContext("example.go", largeGoSource(3), TreeContextOptions{})
+	assert.NoError(t, err)
+
+	assert.Len(t, tc.FindNodesByKind("function_declaration"), 3)
+	assert.Len(t, tc.FindNodesByKind("function_declaration", "import_declaration"), 4)
+	assert.Len(t, tc.FindNodesByKind("call_expression"), 3, "nested nodes are found too")
+	assert.Empty(t, tc.FindNodesByKind("class_definition"))
+}
+
+func TestShowAll(t *testing.T) {
+	source := "package main\n\nfunc main() {\n\tprintln(\"hi\")\n}"
+	tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{
+		ShowLineNumber:      true,
+		MarkLinesOfInterest: true,
+	})
+	assert.NoError(t, err)
+
+	tc.AddLinesOfInterest(tc.Grep("println", false))
+	tc.ShowAll()
+	out := tc.Format()
+
+	assert.NotContains(t, out, "⋮")
+	assert.Equal(t, "  1│package main\n  2│\n  3│func main() {\n  4█\tprintln(\"hi\")\n  5│}\n", out)
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, tc.ShowLines(), "no phantom trailing line")
+}
+
+func TestChildContextBudgetSkipsHeaders(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("package main\n\ntype S struct{}\n\nfunc (s *S) Run(\n")
+	for _, p := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		fmt.Fprintf(&sb, "\t%s int,\n", p)
+	}
+	sb.WriteString(") {\n")
+	for i := 0; i < 60; i++ {
+		fmt.Fprintf(&sb, "\tif a > %d {\n\t\tb++\n\t}\n", i)
+	}
+	sb.WriteString("}\n")
+
+	tc, err := NewTreeContext("run.go", []byte(sb.String()), TreeContextOptions{
+		ShowChildContext: true,
+		HeaderMax:        10,
+	})
+	assert.NoError(t, err)
+
+	// two lines of interest in the same method: its (multi-line) header and a body line
+	tc.AddLinesOfInterest(map[int]struct{}{4: {}, 30: {}})
+	tc.AddContext()
+
+	// the method spans 189 lines, so child context should reveal ~10% (19) body lines,
+	// not counting the header lines 5-11 it also has to show
+	body := 0
+	for _, line := range tc.ShowLines() {
+		if line >= 12 && line != 30 {
+			body++
+		}
+	}
+	for line := 4; line < 12; line++ {
+		assert.Contains(t, tc.ShowLines(), line)
+	}
+	assert.GreaterOrEqual(t, body, 19, tc.ShowLines())
+	assert.LessOrEqual(t, body, 25, tc.ShowLines())
+}
+
+func TestChildContextRevealsBodyLines(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("package main\n\nfunc process() {\n\tfor i := 0; i < n; i++ {\n")
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&sb, "\t\tstep%d(i)\n", i)
+	}
+	sb.WriteString("\t}\n")
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&sb, "\tif ok%d {\n\t\tdone%d()\n\t}\n", i, i)
+	}
+	sb.WriteString("}\n")
+
+	tc, err := NewTreeContext("process.go", []byte(sb.String()), TreeContextOptions{
+		ShowChildContext: true,
+		HeaderMax:        10,
+	})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("func process", false))
+	tc.AddContext()
+
+	// the function spans 103 lines, so about 10 body lines beyond its own (10-line) header
+	// should be revealed. Revealing the loop's header would overshoot what's left of the
+	// budget, so the smaller if blocks after it fill the budget instead.
+	body := 0
+	for _, line := range tc.ShowLines() {
+		if line >= 12 {
+			body++
+		}
+		assert.False(t, line > 12 && line < 45, "loop body line %d beyond its header shouldn't be revealed", line)
+	}
+	assert.GreaterOrEqual(t, body, 8, tc.ShowLines())
+	assert.LessOrEqual(t, body, 12, tc.ShowLines())
+}
+
+func TestSkipComments(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		source   string
+		want     []int
+	}{
+		{
+			name:     "go line comment",
+			filename: "main.go",
+			source:   "package main\n\n// target is unused here\nfunc main() {\n\ttarget() // call target\n}\n",
+			want:     []int{4},
+		},
+		{
+			name:     "go block comment",
+			filename: "main.go",
+			source:   "package main\n\n/*\ntarget\n*/\nvar target = 1\n",
+			want:     []int{5},
+		},
+		{
+			name:     "rust line comment",
+			filename: "main.rs",
+			source:   "// target\nfn main() {\n    target();\n}\n",
+			want:     []int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext(tt.filename, []byte(tt.source), TreeContextOptions{SkipComments: true, Color: true})
+			assert.NoError(t, err)
+
+			found := tc.Grep("target", false)
+			assert.Equal(t, tt.want, mapKeysSorted(found))
+		})
+	}
+
+	t.Run("only code spans are highlighted", func(t *testing.T) {
+		source := "package main\n\nfunc main() {\n\ttarget() // call target\n}\n"
+		tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{SkipComments: true, Color: true})
+		assert.NoError(t, err)
+
+		tc.Grep("target", false)
+		assert.Equal(t, "\t\033[1;31mtarget\033[0m() // call target", tc.outputLines[3])
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		source := "package main\n\n// target\nfunc target() {}\n"
+		tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{2, 3}, mapKeysSorted(tc.Grep("target", false)))
+	})
+}
+
+func TestGrepInStrings(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		source   string
+		want     []int
+	}{
+		{
+			name:     "go",
+			filename: "main.go",
+			source:   "package main\n\nvar greeting = 1\n\nfunc main() {\n\tprintln(\"greeting\", greeting)\n\tprintln(`raw greeting`)\n}\n",
+			want:     []int{5, 6},
+		},
+		{
+			name:     "go comment",
+			filename: "main.go",
+			source:   "package main\n\n// greeting shown on start\nvar greeting = 1\n",
+			want:     []int{2},
+		},
+		{
+			name:     "python",
+			filename: "main.py",
+			source:   "greeting = 1\nprint(\"greeting\")\nprint(greeting)\n",
+			want:     []int{1},
+		},
+		{
+			name:     "rust",
+			filename: "main.rs",
+			source:   "fn greeting() {}\nfn main() {\n    greeting();\n    println!(\"greeting\");\n}\n",
+			want:     []int{3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext(tt.filename, []byte(tt.source), TreeContextOptions{})
+			assert.NoError(t, err)
+
+			found, err := tc.GrepInStrings("greeting", false)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, mapKeysSorted(found))
+		})
+	}
+
+	t.Run("only the string span is recorded", func(t *testing.T) {
+		source := "package main\n\nfunc main() {\n\tprintln(\"greeting\", greeting)\n}\n"
+		tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{})
+		assert.NoError(t, err)
+
+		_, err = tc.GrepInStrings("greeting", false)
+		assert.NoError(t, err)
+		assert.Equal(t, []Match{{Line: 3, Start: 10, End: 18}}, tc.matches[3])
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		tc, err := NewTreeContext("main.go", []byte("package main\n"), TreeContextOptions{})
+		assert.NoError(t, err)
+		_, err = tc.GrepInStrings("(", false)
+		assert.Error(t, err)
+	})
+}
+
+func TestGrepFlags(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"<A>x</A> <a>y</a>\")\n\tprintln(\"none\")\n}\n")
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+
+	// case insensitive and ungreedy: <a>.*</a> stops at the first closing tag
+	found, err := tc.GrepFlags("<a>.*</a>", "iU")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3}, mapKeysSorted(found))
+	assert.Equal(t, []Match{{Line: 3, Start: 10, End: 18}, {Line: 3, Start: 19, End: 27}}, tc.Matches(3))
+
+	// greedy by default
+	_, err = tc.GrepFlags("<a>.*</a>", "i")
+	assert.NoError(t, err)
+	assert.Equal(t, []Match{{Line: 3, Start: 10, End: 27}}, tc.Matches(3))
+
+	found, err = tc.GrepFlags("NONE", "")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	for _, flags := range []string{"x", "i-s", "(?i)"} {
+		_, err = tc.GrepFlags("none", flags)
+		assert.ErrorIs(t, err, ErrorInvalidFlags, flags)
+	}
+	_, err = tc.GrepFlags("(", "i")
+	assert.Error(t, err)
+}
+
+func TestGrepInKinds(t *testing.T) {
+	source := "package main\n\n// counter counts\nvar counter = 1\n\nfunc main() {\n\tcounter++\n\tprintln(\"counter\")\n}\n"
+	tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{Color: true})
+	assert.NoError(t, err)
+
+	found, err := tc.GrepInKinds("count", []string{"identifier"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 6}, mapKeysSorted(found), "the comment and string literal are skipped")
+	assert.Equal(t, []Match{{Line: 6, Start: 1, End: 6}}, tc.Matches(6))
+	assert.Equal(t, "\t\033[1;31mcount\033[0mer++", tc.outputLines[6])
+
+	found, err = tc.GrepInKinds("COUNTER", []string{"interpreted_string_literal"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{7}, mapKeysSorted(found))
+
+	found, err = tc.GrepInKinds("count", []string{"no_such_kind"}, false)
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	_, err = tc.GrepInKinds("(", []string{"identifier"}, false)
+	assert.Error(t, err)
+}
+
+func TestGrepNodeText(t *testing.T) {
+	source := "package main\n\nfunc done() {\n\treturn\n}\n\nfunc pending() {\n\tx := 1\n\t// TODO: handle x\n\t_ = x\n}\n\n// TODO: more\nvar y = 2\n"
+	tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{})
+	assert.NoError(t, err)
+
+	funcs := []string{"function_declaration"}
+	found, err := tc.GrepNodeText("TODO", funcs, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{6}, mapKeysSorted(found), "attributed to the function's first line, not the comment's")
+
+	// a match may span the node's lines
+	found, err = tc.GrepNodeText(`(?s)x := 1.*_ = x`, funcs, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{6}, mapKeysSorted(found))
+	assert.Empty(t, tc.Grep(`x := 1.*_ = x`, false), "per-line grep can't")
+
+	found, err = tc.GrepNodeText("todo", funcs, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{6}, mapKeysSorted(found))
+
+	_, err = tc.GrepNodeText("(", funcs, false)
+	assert.Error(t, err)
+}
+
+func TestHighlightMulti(t *testing.T) {
+	source := "package main\n\nfunc main() {\n\tfoo(bar, foo)\n}\n"
+	newContext := func() *TreeContext {
+		tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{})
+		assert.NoError(t, err)
+		return tc
+	}
+
+	t.Run("distinct colors", func(t *testing.T) {
+		tc := newContext()
+		assert.NoError(t, tc.HighlightMulti([]string{"foo", "bar"}, []string{"1;31", "1;32"}, false))
+		assert.Equal(t, "\t\033[1;31mfoo\033[0m(\033[1;32mbar\033[0m, \033[1;31mfoo\033[0m)", tc.outputLines[3])
+		assert.NotContains(t, tc.outputLines, 2)
+	})
+
+	t.Run("colors cycle", func(t *testing.T) {
+		tc := newContext()
+		assert.NoError(t, tc.HighlightMulti([]string{"foo", "bar", "main"}, []string{"31", "32"}, false))
+		assert.Equal(t, "\t\033[31mfoo\033[0m(\033[32mbar\033[0m, \033[31mfoo\033[0m)", tc.outputLines[3])
+		assert.Equal(t, "func \033[31mmain\033[0m() {", tc.outputLines[2])
+	})
+
+	t.Run("overlaps don't nest", func(t *testing.T) {
+		tc := newContext()
+		assert.NoError(t, tc.HighlightMulti([]string{"foo\\(b", "o\\(bar"}, []string{"31", "32"}, false))
+		assert.Equal(t, "\t\033[31mfoo(b\033[0m\033[32mar\033[0m, foo)", tc.outputLines[3])
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tc := newContext()
+		assert.Error(t, tc.HighlightMulti([]string{"("}, []string{"31"}, false))
+		assert.Error(t, tc.HighlightMulti([]string{"foo"}, nil, false))
+	})
+}
+
+func TestGrepCapture(t *testing.T) {
+	source := "package main\n\nfunc alpha() {}\n\nfunc beta(x int) {}\n"
+	tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{Color: true})
+	assert.NoError(t, err)
+
+	found, err := tc.GrepCapture(`func\s+(?P<name>\w+)`, "name", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 4}, mapKeysSorted(found))
+	assert.Equal(t, "func \033[1;31malpha\033[0m() {}", tc.outputLines[2])
+	assert.Equal(t, "func \033[1;31mbeta\033[0m(x int) {}", tc.outputLines[4])
+	assert.Equal(t, []Match{{Line: 4, Start: 5, End: 9}}, tc.matches[4])
+
+	t.Run("optional group", func(t *testing.T) {
+		tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{})
+		assert.NoError(t, err)
+
+		found, err := tc.GrepCapture(`func \w+\((?P<args>\w.*)?\)`, "args", false)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{2, 4}, mapKeysSorted(found), "lines match even when the group doesn't")
+		assert.NotContains(t, tc.matches, 2)
+		assert.Equal(t, []Match{{Line: 4, Start: 10, End: 15}}, tc.matches[4])
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := tc.GrepCapture(`func\s+(?P<name>\w+)`, "missing", false)
+		assert.ErrorContains(t, err, `"missing"`)
+		_, err = tc.GrepCapture(`(`, "name", false)
+		assert.Error(t, err)
+	})
+}
+
+func TestFormatMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		source   string
+		want     string
+	}{
+		{
+			name:     "go",
+			filename: "main.go",
+			source:   "package main\n\nfunc main() {\n\ttarget()\n}\n",
+			want:     "```go\n⋮...\n│\ttarget()\n⋮...\n```\n",
+		},
+		{
+			name:     "csharp tag",
+			filename: "Main.cs",
+			source:   "class A {\n  void target() {}\n}\n",
+			want:     "```csharp\n⋮...\n│  void target() {}\n⋮...\n```\n",
+		},
+		{
+			name:     "fence longer than backticks in source",
+			filename: "main.go",
+			source:   "package main\n\nvar target = \"```\"\n",
+			want:     "````go\n⋮...\n│var target = \"```\"\n````\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext(tt.filename, []byte(tt.source), TreeContextOptions{Color: true})
+			assert.NoError(t, err)
+
+			tc.AddLinesOfInterest(tc.Grep("target", false))
+			tc.AddContext()
+
+			out := tc.FormatMarkdown()
+			assert.Equal(t, tt.want, out)
+			assert.NotContains(t, out, "\033")
+			assert.Contains(t, tc.Format(), "\033", "color is restored afterwards")
+		})
+	}
+}
+
+func TestFormatHTML(t *testing.T) {
+	source := "package main\n\nfunc main() {\n\tif a < b && target(\"<b>\") {\n\t}\n}\n"
+	tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{Color: true, ShowLineNumber: true})
+	assert.NoError(t, err)
+
+	tc.AddLinesOfInterest(tc.Grep("target", false))
+	tc.AddContext()
+
+	assert.Equal(t, `<div class="grep-ast">
+<div class="ellipsis">⋮...</div>
+<div class="line loi"><span class="lineno">4</span><span class="code">	if a &lt; b &amp;&amp; <span class="match">target</span>(&#34;&lt;b&gt;&#34;) {</span></div>
+<div class="ellipsis">⋮...</div>
+</div>
+`, tc.FormatHTML())
+
+	empty, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, empty.FormatHTML())
+
+	// without line numbers, and with the same lines as Format: the lone blank line between
+	// two gaps is dropped by DropTinyHunks
+	tiny, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{DropTinyHunks: true})
+	assert.NoError(t, err)
+	tiny.AddLinesOfInterest(tiny.Grep("target", false))
+	tiny.AddContext()
+	tiny.showLines[1] = struct{}{}
+	tiny.invalidateShown()
+	assert.Equal(t, `<div class="grep-ast">
+<div class="ellipsis">⋮...</div>
+<div class="line loi"><span class="code">	if a &lt; b &amp;&amp; <span class="match">target</span>(&#34;&lt;b&gt;&#34;) {</span></div>
+<div class="ellipsis">⋮...</div>
+</div>
+`, tiny.FormatHTML())
+}
+
+func TestFormatGrepStyle(t *testing.T) {
+	source := "package main\n\nfunc main() {\n\ttarget()\n\tother()\n\ttarget()\n}\n"
+	tc, err := NewTreeContext("cmd/main.go", []byte(source), TreeContextOptions{Color: true, ShowLineNumber: true})
+	assert.NoError(t, err)
+
+	tc.AddLinesOfInterest(tc.Grep("target", false))
+	tc.AddContext()
+
+	assert.Equal(t, "cmd/main.go:4:\ttarget()\ncmd/main.go:6:\ttarget()\n", tc.FormatGrepStyle())
+}
+
+func TestLineNumberWidth(t *testing.T) {
+	source := largeGoSource(300) // ~1200 lines
+	newContext := func(options TreeContextOptions) *TreeContext {
+		options.ShowLineNumber = true
+		tc, err := NewTreeContext("big.go", source, options)
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep(`Println\((2|299)\)`, false))
+		tc.AddContext()
+		return tc
+	}
+
+	t.Run("auto width", func(t *testing.T) {
+		tc := newContext(TreeContextOptions{ShowCaretUnderline: true})
+		out := tc.Format()
+		assert.Contains(t, out, "\n  14│\tfmt.Println(2)\n")
+		assert.Contains(t, out, "\n1202│\tfmt.Println(299)\n")
+		for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+			if strings.HasPrefix(line, "⋮") {
+				continue
+			}
+			assert.Equal(t, 4, strings.IndexRune(line, '│'), "gutter misaligned: %q", line)
+		}
+	})
+
+	t.Run("small files keep three columns", func(t *testing.T) {
+		tc, err := NewTreeContext("main.go", []byte("package main"), TreeContextOptions{ShowLineNumber: true})
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(map[int]struct{}{0: {}})
+		tc.AddContext()
+		assert.Equal(t, "  1│package main\n", tc.Format())
+	})
+
+	t.Run("custom format", func(t *testing.T) {
+		tc := newContext(TreeContextOptions{LineNumberFormat: "%05d "})
+		out := tc.Format()
+		assert.Contains(t, out, "\n00014 │\tfmt.Println(2)\n")
+		assert.Contains(t, out, "\n01202 │\tfmt.Println(299)\n")
+	})
+}
+
+func TestAddLineOfInterestBases(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\ttarget()\n}\n")
+	newContext := func() *TreeContext {
+		tc, err := NewTreeContext("main.go", source, TreeContextOptions{ShowLineNumber: true})
+		assert.NoError(t, err)
+		return tc
+	}
+
+	zero, one, grep := newContext(), newContext(), newContext()
+	zero.AddLineOfInterest(3)
+	one.AddLineOfInterest1(4)
+	grep.AddLinesOfInterest(grep.Grep("target", false))
+
+	for _, tc := range []*TreeContext{zero, one, grep} {
+		assert.Equal(t, []int{3}, tc.LinesOfInterest())
+		tc.AddContext()
+		assert.Equal(t, "⋮...\n  4│\ttarget()\n⋮...\n", tc.Format())
+	}
+}
+
+func TestMarginOnlyWithTopMatch(t *testing.T) {
+	source := largeGoSource(10)
+	tests := []struct {
+		name    string
+		onlyTop bool
+		pattern string
+		want    []int
+	}{
+		{name: "default adds margin", pattern: `Println\(8\)`, want: []int{0, 1, 2, 3, 37}},
+		{name: "far match skips margin", onlyTop: true, pattern: `Println\(8\)`, want: []int{37}},
+		{name: "match inside margin keeps it", onlyTop: true, pattern: `fmt"`, want: []int{0, 1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext("main.go", source, TreeContextOptions{
+				MarginPadding:          3,
+				MarginOnlyWithTopMatch: tt.onlyTop,
+			})
+			assert.NoError(t, err)
+
+			tc.AddLinesOfInterest(tc.Grep(tt.pattern, false))
+			tc.AddContext()
+			assert.Equal(t, tt.want, tc.ShowLines())
+		})
+	}
+}
+
+func TestCloseSmallGapsLastLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []int
+	}{
+		{name: "trailing newline", source: "package main\n\nvar target = 1\n", want: []int{2}},
+		{name: "no trailing newline", source: "package main\n\nvar target = 1", want: []int{2}},
+		{name: "real blank last line", source: "package main\n\nvar target = 1\n\n", want: []int{2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext("main.go", []byte(tt.source), TreeContextOptions{ShowLineNumber: true})
+			assert.NoError(t, err)
+
+			tc.AddLinesOfInterest(tc.Grep("target", false))
+			tc.AddContext()
+			assert.Equal(t, tt.want, tc.ShowLines())
+		})
+	}
+}
+
+func TestHeaderTruncationMarker(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("package main\n\nfunc long(\n")
+	for _, p := range []string{"a", "b", "c", "d", "e", "target"} {
+		fmt.Fprintf(&sb, "\t%s int,\n", p)
+	}
+	sb.WriteString(") {\n}\n")
+
+	tests := []struct {
+		name      string
+		headerMax int
+		marker    string
+		want      string
+	}{
+		{
+			name:      "truncated",
+			headerMax: 3,
+			marker:    " …",
+			want:      "⋮...\n│func long(\n│\ta int,\n│\tb int, …\n⋮...\n│\ttarget int,\n⋮...\n",
+		},
+		{
+			name:      "no marker by default",
+			headerMax: 3,
+			want:      "⋮...\n│func long(\n│\ta int,\n│\tb int,\n⋮...\n│\ttarget int,\n⋮...\n",
+		},
+		{
+			name:      "not truncated",
+			headerMax: 20,
+			marker:    " …",
+			want:      "⋮...\n│func long(\n│\ta int,\n│\tb int,\n│\tc int,\n│\td int,\n│\te int,\n│\ttarget int,\n⋮...\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext("main.go", []byte(sb.String()), TreeContextOptions{
+				ShowParentContext:      true,
+				HeaderMax:              tt.headerMax,
+				HeaderTruncationMarker: tt.marker,
+			})
+			assert.NoError(t, err)
+
+			tc.AddLinesOfInterest(tc.Grep("target", false))
+			tc.AddContext()
+			assert.Equal(t, tt.want, tc.Format())
+		})
+	}
+}
+
+func TestHeaderMaxByLanguage(t *testing.T) {
+	options := TreeContextOptions{
+		ShowParentContext:   true,
+		HeaderMax:           2,
+		HeaderMaxByLanguage: map[string]int{"java": 4},
+	}
+	files := []struct {
+		filename string
+		source   string
+		want     string
+	}{
+		{
+			filename: "Main.java",
+			source:   "class Main {\n  void run(\n      int a,\n      int b,\n      int c,\n      int target) {\n  }\n}\n",
+			want:     "⋮...\n│  void run(\n│      int a,\n│      int b,\n│      int c,\n│      int target) {\n⋮...\n",
+		},
+		{
+			filename: "main.go",
+			source:   "package main\n\nfunc run(\n\ta int,\n\tb int,\n\tc int,\n\ttarget int,\n) {\n}\n",
+			want:     "⋮...\n│func run(\n│\ta int,\n⋮...\n│\ttarget int,\n⋮...\n",
+		},
+	}
+
+	for _, f := range files {
+		t.Run(f.filename, func(t *testing.T) {
+			tc, err := NewTreeContext(f.filename, []byte(f.source), options)
+			assert.NoError(t, err)
+
+			tc.AddLinesOfInterest(tc.Grep("target", false))
+			tc.AddContext()
+			assert.Equal(t, f.want, tc.Format())
+		})
+	}
+}
+
+func TestSkipErrorNodes(t *testing.T) {
+	broken := []byte("package main\n\nfunc main() {\n\tfoo(1 2\n\t\t3)\n\t@@@\n}\n")
+	countErrorNodes := func(tc *TreeContext) int {
+		n := 0
+		for _, nodes := range tc.nodes {
+			for _, node := range nodes {
+				if node.IsError() || node.IsMissing() {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	tc, err := NewTreeContext("main.go", broken, TreeContextOptions{})
+	assert.NoError(t, err)
+	assert.True(t, tc.HasParseErrors())
+	assert.Greater(t, countErrorNodes(tc), 0)
+
+	skipped, err := NewTreeContext("main.go", broken, TreeContextOptions{SkipErrorNodes: true})
+	assert.NoError(t, err)
+	assert.True(t, skipped.HasParseErrors())
+	assert.Equal(t, 0, countErrorNodes(skipped))
+	assert.NotEmpty(t, skipped.nodes[2], "valid code is still indexed")
+
+	valid, err := NewTreeContext("main.go", []byte("package main\n\nfunc main() {}\n"), TreeContextOptions{})
+	assert.NoError(t, err)
+	assert.False(t, valid.HasParseErrors())
+}
+
+func TestReparse(t *testing.T) {
+	oldSource := []byte("package main\n\nfunc a() {\n\tx()\n}\n\nfunc b() {}\n")
+	newSource := []byte("package main\n\nfunc a() {\n\tx()\n\tif true {\n\t\ty()\n\t}\n}\n\nfunc b() {}\n")
+	options := TreeContextOptions{ShowParentContext: true, HeaderMax: 10}
+
+	tc, err := NewTreeContext("main.go", oldSource, options)
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("x", false))
+	assert.Equal(t, []int{0, 2}, tc.ScopeStarts(4), "line 4 is the closing brace of a")
+
+	// insert three lines after "\tx()\n"
+	at := uint(bytes.Index(oldSource, []byte("}\n")))
+	inserted := uint(len("\tif true {\n\t\ty()\n\t}\n"))
+	err = tc.Reparse(newSource, sitter.InputEdit{
+		StartByte:      at,
+		OldEndByte:     at,
+		NewEndByte:     at + inserted,
+		StartPosition:  sitter.Point{Row: 4, Column: 0},
+		OldEndPosition: sitter.Point{Row: 4, Column: 0},
+		NewEndPosition: sitter.Point{Row: 7, Column: 0},
+	})
+	assert.NoError(t, err)
+
+	fresh, err := NewTreeContext("main.go", newSource, options)
+	assert.NoError(t, err)
+	assert.Equal(t, fresh.SExpression(), tc.SExpression())
+	assert.Equal(t, fresh.scopeStarts, tc.scopeStarts)
+	assert.Equal(t, fresh.scopeIndex, tc.scopeIndex)
+	assert.Equal(t, fresh.header, tc.header)
+	assert.Contains(t, tc.ScopeStarts(5), 4, "y() is inside the new if block")
+	assert.Empty(t, tc.LinesOfInterest(), "lines of interest are cleared")
+
+	for _, c := range []*TreeContext{tc, fresh} {
+		c.AddLinesOfInterest(c.Grep(`y\(`, false))
+		c.AddContext()
+	}
+	assert.Equal(t, fresh.Format(), tc.Format())
+	assert.Contains(t, tc.Format(), "│\tif true {\n│\t\ty()\n")
+
+	// binary content is refused and leaves the context as it was
+	before := tc.SExpression()
+	assert.ErrorIs(t, tc.Reparse([]byte("package main\x00"), sitter.InputEdit{}), ErrorBinaryFile)
+	assert.Equal(t, before, tc.SExpression())
+	assert.Equal(t, string(newSource), strings.Join(tc.Lines(), "\n")+"\n")
+
+	tc.Close()
+	assert.ErrorIs(t, tc.Reparse(newSource, sitter.InputEdit{}), ErrorParseFailed)
+
+	// with a BOM, edit coordinates count it on the first line and are moved past it
+	bom := []byte{0xEF, 0xBB, 0xBF}
+	tc, err = NewTreeContext("main.go", append(bom, "package main\n\nvar x = 1\n"...), options)
+	assert.NoError(t, err)
+	defer tc.Close()
+	edited := append(bom, "package mainly\n\nvar x = 1\n"...)
+	at = uint(len(bom) + len("package main"))
+	err = tc.Reparse(edited, sitter.InputEdit{
+		StartByte:      at,
+		OldEndByte:     at,
+		NewEndByte:     at + 2,
+		StartPosition:  sitter.Point{Row: 0, Column: at},
+		OldEndPosition: sitter.Point{Row: 0, Column: at},
+		NewEndPosition: sitter.Point{Row: 0, Column: at + 2},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "package mainly", tc.OriginalLine(0))
+	assert.Equal(t, "mainly", tc.NodeAt(0, 8).Utf8Text(tc.source), "the package name was re-parsed")
+	fresh, err = NewTreeContext("main.go", edited, options)
+	assert.NoError(t, err)
+	assert.Equal(t, fresh.SExpression(), tc.SExpression())
+}
+
+func TestClone(t *testing.T) {
+	source := []byte("package main\n\nfunc a() {\n\talpha()\n}\n\nfunc b() {\n\tbeta()\n}\n")
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{ShowParentContext: true, HeaderMax: 10, Color: true})
+	assert.NoError(t, err)
+	defer tc.Close()
+
+	patterns := []string{"alpha", "beta"}
+	outputs := make([]string, len(patterns))
+	done := make(chan struct{})
+	for i, pat := range patterns {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			c := tc.Clone()
+			defer c.Close()
+			c.AddLinesOfInterest(c.Grep(pat, false))
+			c.AddContext()
+			outputs[i] = c.Format()
+		}()
+	}
+	for range patterns {
+		<-done
+	}
+
+	assert.Contains(t, outputs[0], "alpha")
+	assert.NotContains(t, outputs[0], "beta")
+	assert.Contains(t, outputs[1], "beta")
+	assert.NotContains(t, outputs[1], "alpha")
+
+	// the original is untouched and still usable after the clones are closed
+	assert.Empty(t, tc.LinesOfInterest())
+	assert.Empty(t, tc.outputLines)
+	assert.NotNil(t, tc.RootNode())
+	tc.AddLinesOfInterest(tc.Grep("alpha", false))
+	tc.AddContext()
+	assert.Equal(t, outputs[0], tc.Format())
+}
+
+// TestConcurrentGrep is meant to be run with -race.
+func TestConcurrentGrep(t *testing.T) {
+	tc, err := NewTreeContext("big.go", largeGoSource(50), TreeContextOptions{Color: true})
+	assert.NoError(t, err)
+
+	patterns := []string{"Println", `f\d+`, "fmt", "func", `\(\d+\)`, "main"}
+	results := make(chan map[int]struct{}, len(patterns))
+	for _, pat := range patterns {
+		go func() {
+			found := tc.Grep(pat, false)
+			tc.AddLinesOfInterest(found)
+			results <- found
+		}()
+	}
+
+	want := make(map[int]struct{})
+	for range patterns {
+		for line := range <-results {
+			want[line] = struct{}{}
+		}
+	}
+	assert.Equal(t, mapKeysSorted(want), tc.LinesOfInterest())
+	assert.Len(t, tc.outputLines, len(want))
+}
+
+func TestStats(t *testing.T) {
+	source := largeGoSource(10) // 43 lines
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, FormatStats{HiddenLines: 43}, tc.Stats())
+
+	tc.AddLinesOfInterest(tc.Grep(`Println\((2|3|8)\)`, false))
+	tc.AddContext()
+
+	assert.Equal(t, []int{13, 17, 37}, tc.ShowLines())
+	assert.Equal(t, FormatStats{ShownLines: 3, HiddenLines: 40, HunkCount: 3, MatchCount: 3}, tc.Stats())
+
+	// padding merges the first two matches into one hunk: 12-18 (15 filled by the gap closer)
+	// plus the blank line 19, then 36-39
+	padded, err := NewTreeContext("main.go", source, TreeContextOptions{LinesOfInterestPadding: 1})
+	assert.NoError(t, err)
+	padded.AddLinesOfInterest(padded.Grep(`Println\((2|3|8)\)`, false))
+	padded.AddContext()
+	assert.Equal(t, FormatStats{ShownLines: 12, HiddenLines: 31, HunkCount: 2, MatchCount: 3}, padded.Stats())
+
+	tc.ShowAll()
+	assert.Equal(t, FormatStats{ShownLines: 43, HunkCount: 1, MatchCount: 3}, tc.Stats())
+}
+
+func TestFindByField(t *testing.T) {
+	source := []byte(`package main
+
+func NewServer() *Server {
+	return &Server{}
+}
+
+func newHelper() {}
+
+func (s *Server) NewRequest() {}
+
+func main() {
+	NewServer()
+	var NewLocal int
+	_ = NewLocal
+}
+`)
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+
+	found, err := tc.FindByField("name", "^New")
+	assert.NoError(t, err)
+	// the call on line 11 has a "function" field, not a "name" one
+	assert.Equal(t, []int{2, 8, 12}, mapKeysSorted(found))
+
+	found, err = tc.FindByField("receiver", `\*Server`)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{8}, mapKeysSorted(found))
+
+	_, err = tc.FindByField("name", "(")
+	assert.Error(t, err)
+}
+
+func TestMaxOutputLines(t *testing.T) {
+	source := []byte(`package main
+
+import "fmt"
+
+func main() {
+	for i := 0; i < 10; i++ {
+		fmt.Println(i)
+		fmt.Println(i * 2)
+		fmt.Println(i * 3)
+		fmt.Println(i * 4)
+		fmt.Println("target")
+		fmt.Println(i * 5)
+		fmt.Println(i * 6)
+	}
+}
+`)
+	options := TreeContextOptions{
+		ShowParentContext: true,
+		ShowChildContext:  true,
+		MarginPadding:     3,
+		HeaderMax:         1,
+	}
+
+	build := func(limit int) *TreeContext {
+		opts := options
+		opts.MaxOutputLines = limit
+		tc, err := NewTreeContext("main.go", source, opts)
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep("target", false))
+		tc.AddContext()
+		return tc
+	}
+
+	full := build(0)
+	assert.False(t, full.Truncated())
+	assert.Greater(t, len(full.ShowLines()), 3)
+
+	// parent headers outlive the margin and other context
+	tc := build(3)
+	assert.True(t, tc.Truncated())
+	assert.Equal(t, []int{4, 5, 10}, tc.ShowLines())
+
+	tc = build(1)
+	assert.True(t, tc.Truncated())
+	assert.Equal(t, []int{10}, tc.ShowLines())
+
+	// lines of interest are kept even when they alone exceed the cap
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{MaxOutputLines: 1})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(map[int]struct{}{6: {}, 8: {}})
+	tc.AddContext()
+	assert.Equal(t, []int{6, 8}, tc.ShowLines())
+	assert.True(t, tc.Truncated())
+}
+
+func TestFormatSingleEllipsisPerGap(t *testing.T) {
+	var src strings.Builder
+	for i := 0; i < 12; i++ {
+		fmt.Fprintf(&src, "line%d\n", i)
+	}
+
+	tests := []struct {
+		name          string
+		dropTinyHunks bool
+		want          string
+	}{
+		{
+			name: "islands kept",
+			want: "⋮...\n│line2\n⋮...\n│line5\n⋮...\n│line8\n│line9\n⋮...\n",
+		},
+		{
+			name:          "islands dropped",
+			dropTinyHunks: true,
+			want:          "⋮...\n│line2\n⋮...\n│line8\n│line9\n⋮...\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext("notes.txt", []byte(src.String()), TreeContextOptions{Language: "bash", DropTinyHunks: tt.dropTinyHunks})
+			assert.NoError(t, err)
+			// line 2 is a line of interest, so it survives even as an island; -1 and 40 are out of range
+			tc.linesOfInterest[2] = struct{}{}
+			for _, line := range []int{-1, 2, 5, 8, 9, 40} {
+				tc.showLines[line] = struct{}{}
+			}
+
+			out := tc.Format()
+			assert.Equal(t, tt.want, out)
+			assert.NotContains(t, out, "⋮...\n⋮...")
+		})
+	}
+}
+
+func TestShowSiblingSignatures(t *testing.T) {
+	source := []byte(`package main
+
+type Server struct {
+	addr string
+}
+
+func (s *Server) Start() error {
+	return nil
+}
+
+func (s *Server) Stop(
+	force bool,
+) error {
+	return nil
+}
+
+func (s *Server) Addr() string {
+	return s.addr // needle
+}
+`)
+
+	for _, siblings := range []bool{false, true} {
+		tc, err := NewTreeContext("server.go", source, TreeContextOptions{
+			ShowParentContext:     true,
+			HeaderMax:             10,
+			ShowSiblingSignatures: siblings,
+		})
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep("needle", false))
+		tc.AddContext()
+		out := tc.Format()
+
+		assert.Contains(t, out, "│func (s *Server) Addr() string {")
+		for _, line := range []string{"│type Server struct {", "│func (s *Server) Start() error {", "│func (s *Server) Stop(", "│\tforce bool,", "│) error {"} {
+			if siblings {
+				assert.Contains(t, out, line)
+			} else {
+				assert.NotContains(t, out, line)
+			}
+		}
+		// bodies stay hidden
+		assert.NotContains(t, out, "\taddr string")
+		assert.NotContains(t, out, "return nil")
+	}
+}
+
+func TestExpandToStatement(t *testing.T) {
+	source := []byte(`package main
+
+func main() {
+	setup()
+	result := compute(
+		first,
+		needle,
+		third,
+	)
+	if result > 0 {
+		report(result)
+	}
+	for _, x := range []int{
+		1, 2,
+	} {
+		other(x)
+		also(x)
+	}
+}
+`)
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    []int
+	}{
+		{name: "argument of a split call", pattern: "needle", want: []int{4, 5, 6, 7, 8}},
+		{name: "first line of a split call", pattern: "compute", want: []int{4, 5, 6, 7, 8}},
+		{name: "single-line statement", pattern: "report", want: []int{10}},
+		{name: "block header is not expanded", pattern: "if result", want: []int{9}},
+		{name: "body line of a loop", pattern: "other", want: []int{15}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext("main.go", source, TreeContextOptions{ExpandToStatement: true})
+			assert.NoError(t, err)
+			tc.AddLinesOfInterest(tc.Grep(tt.pattern, false))
+			tc.AddContext()
+			assert.Equal(t, tt.want, tc.ShowLines())
+		})
+	}
+}
+
+func TestShowBuildDirectives(t *testing.T) {
+	source := []byte(`// Copyright 2026 The Authors.
+
+//go:build linux && amd64
+// +build linux,amd64
+
+// Package sys wraps syscalls.
+package sys
+
+//go:generate stringer -type=Mode
+
+func open() {
+	needle()
+}
+`)
+
+	for _, directives := range []bool{false, true} {
+		tc, err := NewTreeContext("sys_linux.go", source, TreeContextOptions{ShowBuildDirectives: directives})
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep("needle", false))
+		tc.AddContext()
+		out := tc.Format()
+
+		for _, line := range []string{"│//go:build linux && amd64\n", "│// +build linux,amd64\n"} {
+			if directives {
+				assert.Contains(t, out, line)
+			} else {
+				assert.NotContains(t, out, line)
+			}
+		}
+		// only the leading comment block counts
+		assert.NotContains(t, out, "Copyright")
+		assert.NotContains(t, out, "//go:generate")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tneedle := \"名needle\"\n\tprintln(needle)\n}\n")
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{Color: true})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+
+	assert.Equal(t, []int{3, 4}, tc.MatchedLines())
+	assert.Equal(t, []Match{{Line: 3, Start: 1, End: 7}, {Line: 3, Start: 15, End: 21}}, tc.Matches(3))
+	assert.Nil(t, tc.Matches(0))
+
+	for _, line := range tc.MatchedLines() {
+		spans := tc.Matches(line)
+		for _, m := range spans {
+			assert.Equal(t, "needle", tc.OriginalLine(line)[m.Start:m.End])
+		}
+		// the stored spans reproduce the highlighted line from the raw one
+		assert.Equal(t, tc.outputLines[line], highlightSpans(tc.OriginalLine(line), spans))
+	}
+
+	// the returned slice is a copy
+	tc.Matches(3)[0].Start = 99
+	assert.Equal(t, 1, tc.Matches(3)[0].Start)
+}
+
+func TestHighlightFunc(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"needle and needle\")\n}\n")
+	wrap := func(match string) string { return "<<" + match + ">>" }
+
+	for _, color := range []bool{false, true} {
+		tc, err := NewTreeContext("main.go", source, TreeContextOptions{Color: color, HighlightFunc: wrap})
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep("needle", false))
+		tc.AddContext()
+		out := tc.Format()
+
+		assert.Contains(t, out, `│	println("<<needle>> and <<needle>>")`)
+		assert.NotContains(t, out, "\033[1;31m")
+	}
+
+	// without a function, color still means the red ANSI wrapper
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{Color: true})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+	tc.AddContext()
+	assert.Contains(t, tc.Format(), "\033[1;31mneedle\033[0m")
+}
+
+func TestProfiles(t *testing.T) {
+	assert.Equal(t, TreeContextOptions{
+		ShowLineNumber:      true,
+		ShowParentContext:   true,
+		MarkLinesOfInterest: true,
+		HeaderMax:           1,
+	}, CompactProfile())
+	assert.Equal(t, TreeContextOptions{
+		ShowLineNumber:           true,
+		ShowParentContext:        true,
+		ShowChildContext:         true,
+		MarginPadding:            3,
+		MarkLinesOfInterest:      true,
+		HeaderMax:                10,
+		ShowTopOfFileParentScope: true,
+		LinesOfInterestPadding:   1,
+		ShowScopeClosers:         true,
+	}, FullProfile())
+
+	// the full profile shows more of the file than the compact one
+	source := largeGoSource(5)
+	shown := func(options TreeContextOptions) int {
+		tc, err := NewTreeContext("example.go", source, options)
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep("Println\\(3\\)", false))
+		tc.AddContext()
+		return len(tc.ShowLines())
+	}
+	assert.Less(t, shown(CompactProfile()), shown(FullProfile()))
+}
+
+func TestGrepChain(t *testing.T) {
+	source := largeGoSource(4)
+	options := TreeContextOptions{ShowParentContext: true, HeaderMax: 10}
+
+	tc, err := NewTreeContext("example.go", source, options)
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("Println\\(2\\)", false))
+	tc.AddLinesOfInterest(tc.Grep("f0", false))
+	tc.AddContext()
+	want := tc.Format()
+
+	chained, err := NewTreeContext("example.go", source, options)
+	assert.NoError(t, err)
+	assert.Equal(t, want, chained.GrepChain("Println\\(2\\)", false).GrepChain("f0", false).WithContext().Format())
+	assert.Equal(t, []int{4, 13}, chained.LinesOfInterest())
+
+	assert.Panics(t, func() { chained.GrepChain("(", false) })
+}
+
+func TestShowTopOfFileParentScopePackageLine(t *testing.T) {
+	source := []byte(`// Copyright 2026 The Authors.
+// Use of this source code is governed by a license.
+
+// Package deep nests things.
+package deep
+
+import "fmt"
+
+func outer() {
+	if true {
+		for {
+			fmt.Println("needle")
+		}
+	}
+}
+`)
+
+	for _, headerMax := range []int{0, 1, 3, 10} {
+		t.Run(fmt.Sprintf("HeaderMax %d", headerMax), func(t *testing.T) {
+			for _, top := range []bool{false, true} {
+				tc, err := NewTreeContext("deep.go", source, TreeContextOptions{
+					ShowParentContext:        true,
+					ShowTopOfFileParentScope: top,
+					HeaderMax:                headerMax,
+				})
+				assert.NoError(t, err)
+				tc.AddLinesOfInterest(tc.Grep("needle", false))
+				tc.AddContext()
+
+				if top {
+					assert.Contains(t, tc.Format(), "│package deep\n")
+				} else {
+					assert.NotContains(t, tc.Format(), "│package deep\n")
+				}
+			}
+		})
+	}
+}
+
+func TestAlwaysShowFinalLine(t *testing.T) {
+	source := []byte(`package main
+
+func main() {
+	if true {
+		println("needle")
+	}
+}
+
+func last() {
+	println("end")
+}
+`)
+	baseline, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	baseline.AddLinesOfInterest(baseline.Grep("needle", false))
+	baseline.AddContext()
+
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{AlwaysShowFinalLine: true})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+	tc.AddContext()
+
+	// only the closing brace of last() is added, not its scope
+	assert.Equal(t, append(baseline.ShowLines(), 10), tc.ShowLines())
+	assert.Contains(t, tc.Format(), "⋮...\n│}\n")
+
+	// trailing blank lines are skipped
+	tc, err = NewTreeContext("main.go", append(source, "\n\n"...), TreeContextOptions{AlwaysShowFinalLine: true})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+	tc.AddContext()
+	assert.Contains(t, tc.ShowLines(), 10)
+}
+
+func TestTrailingNewlineIndependence(t *testing.T) {
+	withoutNewline := []byte(`package main
+
+func main() {
+	if true {
+		println("needle")
+	}
+}
+
+func last() {
+	println("end")
+}`)
+	withNewline := append(append([]byte(nil), withoutNewline...), '\n')
+
+	tests := []struct {
+		name    string
+		options TreeContextOptions
+		pattern string
+		all     bool
+	}{
+		{name: "match in the middle", options: TreeContextOptions{ShowParentContext: true, HeaderMax: 10}, pattern: "needle"},
+		{name: "match on the last line", options: TreeContextOptions{ShowLineNumber: true}, pattern: "^}"},
+		{name: "padding past the end", options: TreeContextOptions{LinesOfInterestPadding: 3}, pattern: "end"},
+		{name: "last line", options: TreeContextOptions{ShowLastLine: true, ShowParentContext: true, HeaderMax: 10}, pattern: "needle"},
+		{name: "final line", options: TreeContextOptions{AlwaysShowFinalLine: true}, pattern: "needle"},
+		{name: "show all", options: TreeContextOptions{ShowLineNumber: true}, all: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			render := func(source []byte) (string, string, FormatStats) {
+				tc, err := NewTreeContext("main.go", source, tt.options)
+				assert.NoError(t, err)
+				if tt.all {
+					tc.ShowAll()
+				} else {
+					tc.AddLinesOfInterest(tc.Grep(tt.pattern, false))
+					tc.AddContext()
+				}
+				return tc.Format(), tc.FormatHTML(), tc.Stats()
+			}
+
+			format, html, stats := render(withoutNewline)
+			formatNL, htmlNL, statsNL := render(withNewline)
+			assert.Equal(t, format, formatNL)
+			assert.Equal(t, html, htmlNL)
+			assert.Equal(t, stats, statsNL)
+		})
+	}
+}
+
+func TestGrepFormat(t *testing.T) {
+	source := largeGoSource(5)
+	options := FullProfile()
+
+	tc, err := NewTreeContext("example.go", source, options)
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("Println\\(3\\)", false))
+	tc.AddContext()
+	want := tc.Format()
+
+	got, err := GrepFormat("example.go", source, "Println\\(3\\)", options)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	got, err = GrepFormat("example.go", source, "no such thing", options)
+	assert.NoError(t, err)
+	assert.Equal(t, "", got)
+
+	_, err = GrepFormat("example.go", source, "(", options)
+	assert.Error(t, err)
+	_, err = GrepFormat("notes.xyz", []byte("x"), "x", options)
+	assert.ErrorIs(t, err, ErrorUnrecognizedFiletype)
+}
+
+func TestGrepAnchors(t *testing.T) {
+	source := "package main\n\nfunc main() {\n\tif x {\n\t\tgo func() {}()\n\t}\n}\n"
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    map[int]struct{}
+	}{
+		{name: "start of line", pattern: "^func", want: map[int]struct{}{2: {}}},
+		{name: "end of line", pattern: `\}$`, want: map[int]struct{}{5: {}, 6: {}}},
+		{name: "multi-line flag is a no-op", pattern: "(?m)^func", want: map[int]struct{}{2: {}}},
+		{name: "text anchors are line anchors", pattern: `\Afunc`, want: map[int]struct{}{2: {}}},
+		{name: "no match spans lines", pattern: `\{\n`, want: map[int]struct{}{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, eol := range []string{"\n", "\r\n"} {
+				tc, err := NewTreeContext("main.go", []byte(strings.ReplaceAll(source, "\n", eol)), TreeContextOptions{Color: true})
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, tc.Grep(tt.pattern, false), "line endings %q", eol)
+			}
+		})
+	}
+
+	// highlighting keeps the carriage return
+	tc, err := NewTreeContext("main.go", []byte("package main\r\n\r\nvar x = y{}\r\n"), TreeContextOptions{Color: true})
+	assert.NoError(t, err)
+	tc.Grep(`\}$`, false)
+	assert.Equal(t, "var x = y{\033[1;31m}\033[0m\r", tc.outputLines[2])
+}
+
+func TestNoLeadingReset(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"needle\")\n}\n")
+
+	for _, noReset := range []bool{false, true} {
+		tc, err := NewTreeContext("main.go", source, TreeContextOptions{Color: true, NoLeadingReset: noReset})
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep("needle", false))
+		tc.AddContext()
+		out := tc.Format()
+
+		if noReset {
+			assert.True(t, strings.HasPrefix(out, "⋮...\n"), out)
+		} else {
+			assert.True(t, strings.HasPrefix(out, "\033[0m\n⋮...\n"), out)
+		}
+		assert.Contains(t, out, "\033[1;31mneedle\033[0m")
+	}
+}
+
+func TestGutterSeparator(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"needle\")\n}\n")
+
+	tests := []struct {
+		name string
+		opts TreeContextOptions
+		want string
+	}{
+		{
+			name: "default",
+			opts: TreeContextOptions{ShowParentContext: true, HeaderMax: 1, ShowLineNumber: true, MarkLinesOfInterest: true},
+			want: "⋮...\n  3│func main() {\n  4█\tprintln(\"needle\")\n⋮...\n",
+		},
+		{
+			name: "custom glyph",
+			opts: TreeContextOptions{ShowParentContext: true, HeaderMax: 1, ShowLineNumber: true, MarkLinesOfInterest: true, Separator: "|"},
+			want: "⋮...\n  3|func main() {\n  4█\tprintln(\"needle\")\n⋮...\n",
+		},
+		{
+			name: "padded",
+			opts: TreeContextOptions{ShowParentContext: true, HeaderMax: 1, ShowLineNumber: true, MarkLinesOfInterest: true, Separator: ":", PadSeparator: true},
+			want: "⋮...\n  3 : func main() {\n  4 █ \tprintln(\"needle\")\n⋮...\n",
+		},
+		{
+			name: "padded caret",
+			opts: TreeContextOptions{ShowParentContext: true, HeaderMax: 1, ShowCaretUnderline: true, PadSeparator: true},
+			want: "⋮...\n │ func main() {\n │ \tprintln(\"needle\")\n │ \t         ^^^^^^\n⋮...\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext("main.go", source, tt.opts)
+			assert.NoError(t, err)
+			tc.AddLinesOfInterest(tc.Grep("needle", false))
+			tc.AddContext()
+			assert.Equal(t, tt.want, tc.Format())
+		})
+	}
+}
+
+func TestIncludeAnnotations(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		source   string
+		pattern  string
+		without  []int
+		want     []int
+	}{
+		{
+			name:     "python decorators",
+			filename: "app.py",
+			source:   "import functools\n\n# cached lookup\n@functools.cache\n@trace(\n    level=1,\n)\ndef lookup(key):\n    x = 1\n    return needle\n",
+			pattern:  "needle",
+			without:  []int{2, 3, 7, 8, 9},
+			want:     []int{2, 3, 4, 5, 6, 7, 8, 9},
+		},
+		{
+			// java annotations belong to the declaration's modifiers, so its header has them
+			name:     "java annotations",
+			filename: "App.java",
+			source:   "class App {\n    @Override\n    @Deprecated\n    public String toString() {\n        int x = 1;\n        return needle;\n    }\n}\n",
+			pattern:  "needle",
+			without:  []int{1, 2, 3, 4, 5},
+			want:     []int{1, 2, 3, 4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := TreeContextOptions{ShowParentContext: true, HeaderMax: 1, IncludeLeadingComments: true}
+			tc, err := NewTreeContext(tt.filename, []byte(tt.source), opts)
+			assert.NoError(t, err)
+			tc.AddLinesOfInterest(tc.Grep(tt.pattern, false))
+			tc.AddContext()
+			assert.Equal(t, tt.without, tc.ShowLines())
+
+			opts.IncludeAnnotations = true
+			tc, err = NewTreeContext(tt.filename, []byte(tt.source), opts)
+			assert.NoError(t, err)
+			tc.AddLinesOfInterest(tc.Grep(tt.pattern, false))
+			tc.AddContext()
+			assert.Equal(t, tt.want, tc.ShowLines())
+		})
+	}
+}
+
+func TestIncludeUnnamedNodes(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"x\")\n}\n")
+
+	kinds := func(tc *TreeContext, line int) []string {
+		var out []string
+		for _, node := range tc.nodes[line] {
+			out = append(out, node.Kind())
+		}
+		return out
+	}
+
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, kinds(tc, 4), "only named nodes are indexed by default")
+	assert.Equal(t, []int{0, 2}, tc.ScopeStarts(4))
+
+	tc, err = NewTreeContext("main.go", source, TreeContextOptions{IncludeUnnamedNodes: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"}"}, kinds(tc, 4), "the closing brace is indexed")
+	assert.Equal(t, []int{0, 2, 4}, tc.ScopeStarts(4))
+	assert.Contains(t, kinds(tc, 2), "func")
+}
+
+func TestSmallScopeThreshold(t *testing.T) {
+	// big spans lines 2-9 (0-based), 8 lines
+	source := []byte("package main\n\nfunc big() {\n\ta := 1\n\tb := 2\n\tc := 3\n\td := 4\n\te := 5\n\tprintln(a, b, c, d, e)\n}\n")
+
+	for _, tt := range []struct {
+		threshold int
+		full      bool
+	}{
+		{threshold: 0, full: false},
+		{threshold: 7, full: false},
+		{threshold: 8, full: true},
+		{threshold: 10, full: true},
+	} {
+		tc, err := NewTreeContext("main.go", source, TreeContextOptions{ShowChildContext: true, SmallScopeThreshold: tt.threshold})
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep("func big", false))
+		tc.AddContext()
+		if tt.full {
+			assert.Equal(t, []int{2, 3, 4, 5, 6, 7, 8, 9}, tc.ShowLines(), "threshold %d", tt.threshold)
+		} else {
+			assert.NotContains(t, tc.ShowLines(), 5, "threshold %d", tt.threshold)
+		}
+	}
+}
+
+func TestNoTrailingBlankPickup(t *testing.T) {
+	source := []byte("package main\n\nvar a = 1\n\nvar b = 2\nvar c = 3\n\nvar d = 4\n")
+
+	for _, noPickup := range []bool{false, true} {
+		tc, err := NewTreeContext("main.go", source, TreeContextOptions{NoTrailingBlankPickup: noPickup})
+		assert.NoError(t, err)
+		tc.AddLineOfInterest(2)
+		tc.AddLineOfInterest(5)
+		tc.AddLineOfInterest(7)
+		tc.AddContext()
+
+		if noPickup {
+			// the one-line gap between 5 and 7 is still closed
+			assert.Equal(t, []int{2, 5, 6, 7}, tc.ShowLines())
+		} else {
+			assert.Equal(t, []int{2, 3, 5, 6, 7}, tc.ShowLines())
+		}
+	}
+}
+
+func TestAddContextDeterministic(t *testing.T) {
+	// nested scopes: each line of interest's child context sees what the others revealed
+	var sb strings.Builder
+	sb.WriteString("package main\n\nfunc outer() {\n")
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&sb, "\tif x%d {\n", i)
+		for j := 0; j < 4; j++ {
+			fmt.Fprintf(&sb, "\t\tif y%d%d {\n\t\t\tcall(%d, %d)\n\t\t\tcall(%d, %d)\n\t\t}\n", i, j, i, j, i, j)
+		}
+		sb.WriteString("\t}\n")
+	}
+	sb.WriteString("}\n")
+	source := []byte(sb.String())
+	opts := TreeContextOptions{ShowParentContext: true, ShowChildContext: true, HeaderMax: 1, ShowLineNumber: true}
+
+	format := func() string {
+		tc, err := NewTreeContext("nested.go", source, opts)
+		assert.NoError(t, err)
+		tc.AddLinesOfInterest(tc.Grep(`^func outer|^\tif x[024]`, false))
+		tc.AddContext()
+		return tc.Format()
+	}
+
+	want := format()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, want, format())
+	}
+}
+
 // func TestAddChildContext(t *testing.T) {
 // 	sourceCode := []byte(`
 // 	import "fmt"
@@ -234,3 +2997,130 @@ func main() {
 		assert.Contains(t, out, "...", "Should show ellipsis")
 	})
 }
+
+// largeGoSource returns a synthetic Go file with n small functions.
+func largeGoSource(n int) []byte {
+	var sb strings.Builder
+	sb.WriteString("package main\n\nimport \"fmt\"\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "\nfunc f%d() {\n\tfmt.Println(%d)\n}\n", i, i)
+	}
+	return []byte(sb.String())
+}
+
+func BenchmarkNewTreeContextLargeFile(b *testing.B) {
+	source := largeGoSource(20000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tc, err := NewTreeContext("large.go", source, TreeContextOptions{HeaderMax: 10})
+		if err != nil {
+			b.Fatal(err)
+		}
+		tc.Close()
+	}
+}
+
+func BenchmarkSplitLargeSource(b *testing.B) {
+	source := largeGoSource(20000)
+	b.Run("strings.Split", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = strings.Split(string(source), "\n")
+		}
+	})
+	b.Run("lineStartOffsets", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = lineStartOffsets(source)
+		}
+	})
+}
+
+func BenchmarkGrepManyContexts(b *testing.B) {
+	var contexts []*TreeContext
+	for i := 0; i < 100; i++ {
+		tc, err := NewTreeContext("example.go", largeGoSource(5), TreeContextOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		contexts = append(contexts, tc)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tc := range contexts {
+			tc.Grep(`fmt\.Println\((\d+)\)`, true)
+		}
+	}
+}
+
+func BenchmarkAddContextManyLinesOfInterest(b *testing.B) {
+	source := largeGoSource(2000)
+	options := TreeContextOptions{
+		ShowParentContext: true,
+		ShowChildContext:  true,
+		ShowLastLine:      true,
+		HeaderMax:         10,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tc, err := NewTreeContext("large.go", source, options)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tc.AddLinesOfInterest(tc.Grep(`^func|Println`, false))
+		b.StartTimer()
+
+		tc.AddContext()
+
+		b.StopTimer()
+		tc.Close()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkFormatSparseMatches(b *testing.B) {
+	source := largeGoSource(20000)
+	tc, err := NewTreeContext("large.go", source, TreeContextOptions{
+		ShowLineNumber:    true,
+		ShowParentContext: true,
+		HeaderMax:         10,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	tc.AddLinesOfInterest(tc.Grep(`Println\(\d*000\)`, false))
+	tc.AddContext()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Format()
+	}
+}
+
+func BenchmarkFormatToDiscard(b *testing.B) {
+	tc, err := NewTreeContext("large.go", largeGoSource(5000), TreeContextOptions{ShowLineNumber: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	tc.AddLinesOfInterest(tc.Grep(`Println`, false))
+	tc.AddContext()
+
+	b.Run("Unbuffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tc.formatTo(io.Discard)
+		}
+	})
+	b.Run("Buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tc.FormatTo(io.Discard)
+		}
+	})
+}
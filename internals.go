@@ -2,12 +2,16 @@ package grepast
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"unicode"
 
 	sitter "github.com/tree-sitter/go-tree-sitter"
 	sitter_bash "github.com/tree-sitter/tree-sitter-bash/bindings/go"
@@ -22,11 +26,18 @@ import (
 	sitter_typescript "github.com/tree-sitter/tree-sitter-typescript/bindings/go"
 )
 
+// Sentinel errors returned (wrapped with the offending filename or query) by
+// GetLanguageFromFileName, NewTreeContext and RunQuery. Match them with errors.Is.
 var (
 	ErrorUnrecognizedFiletype = fmt.Errorf("unrecognized file type")
 	ErrorUnsupportedLanguage  = fmt.Errorf("unsupported language")
+	ErrorParseFailed          = fmt.Errorf("failed to parse source")
+	ErrorBinaryFile           = fmt.Errorf("binary file")
+	ErrorInvalidQuery         = fmt.Errorf("invalid query")
+	ErrorInvalidFlags         = fmt.Errorf("invalid regexp flags")
 )
 
+// extensionMap maps file extensions to language names.
 var extensionMap = map[string]string{
 	".bash":   "bash",
 	".cc":     "cpp",
@@ -35,6 +46,7 @@ var extensionMap = map[string]string{
 	".cpp":    "cpp",
 	".cs":     "c_sharp",
 	".csm":    "scheme",
+	".cts":    "typescript",
 	".css":    "css",
 	".el":     "elisp",
 	".ex":     "elixir",
@@ -56,11 +68,13 @@ var extensionMap = map[string]string{
 	".lua":    "lua",
 	".mjs":    "javascript",
 	".mk":     "make",
+	".mts":    "typescript",
 	".ml":     "ocaml",
 	".m":      "objc",
 	".php":    "php",
 	".pl":     "perl",
 	".py":     "python",
+	".pyi":    "python",
 	".ql":     "ql",
 	".r":      "r",
 	".regex":  "regex",
@@ -72,47 +86,301 @@ var extensionMap = map[string]string{
 	".sqlite": "sqlite",
 	".toml":   "toml",
 	".ts":     "typescript",
-	".tsx":    "typescript",
+	".tsx":    "tsx",
 	".yaml":   "yaml",
 }
 
+// filenameMap maps basenames that carry no conventional extension to language names.
+// It is consulted before extensionMap. None of these has a vendored grammar yet, so they are
+// recognized but report ErrorUnsupportedLanguage:
+//
+//	Dockerfile (any case)          dockerfile
+//	Makefile, makefile, GNUmakefile make
+//	go.mod, go.work                gomod
+//	go.sum                         gosum
+var filenameMap = map[string]string{
+	"dockerfile":  "dockerfile",
+	"Makefile":    "make",
+	"makefile":    "make",
+	"GNUmakefile": "make",
+	"go.mod":      "gomod",
+	"go.work":     "gomod",
+	"go.sum":      "gosum",
+}
+
 // GetLanguageFromFileName maps file name to tree-sitter Language instances
 func GetLanguageFromFileName(path string) (*sitter.Language, string, error) {
-
-	if strings.EqualFold(filepath.Base(path), "Dockerfile") {
-		return nil, "Dockerfile", nil
+	base := filepath.Base(path)
+	if strings.EqualFold(base, "Dockerfile") {
+		base = "dockerfile"
+	}
+	if lang, ok := filenameMap[base]; ok {
+		language, err := GetLanguage(lang)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w (%s)", err, path)
+		}
+		return language, lang, nil
 	}
 
 	ext := strings.ToLower(filepath.Ext(path))
 
 	if lang, ok := extensionMap[ext]; ok {
-		switch lang {
-		case "bash":
-			return sitter.NewLanguage(sitter_bash.Language()), lang, nil
-		case "c_sharp":
-			return sitter.NewLanguage(sitter_c_sharp.Language()), lang, nil
-		case "css":
-			return sitter.NewLanguage(sitter_css.Language()), lang, nil
-		case "go":
-			return sitter.NewLanguage(sitter_go.Language()), lang, nil
-		case "java":
-			return sitter.NewLanguage(sitter_java.Language()), lang, nil
-		case "javascript":
-			return sitter.NewLanguage(sitter_javascript.Language()), lang, nil
-		case "html":
-			return sitter.NewLanguage(sitter_html.Language()), lang, nil
-		case "python":
-			return sitter.NewLanguage(sitter_python.Language()), lang, nil
-		case "typescript":
-			return sitter.NewLanguage(sitter_typescript.LanguageTypescript()), lang, nil
-		case "rust":
-			return sitter.NewLanguage(sitter_rust.Language()), lang, nil
-		default:
-			return nil, "", ErrorUnsupportedLanguage
+		language, err := GetLanguage(lang)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w (%s)", err, path)
+		}
+		return language, lang, nil
+	}
+
+	return nil, "", fmt.Errorf("%w (%s)", ErrorUnrecognizedFiletype, path)
+}
+
+// GetLanguage maps a language name (as used in extensionMap) to a tree-sitter Language instance.
+func GetLanguage(lang string) (*sitter.Language, error) {
+	switch lang {
+	case "bash":
+		return sitter.NewLanguage(sitter_bash.Language()), nil
+	case "c_sharp":
+		return sitter.NewLanguage(sitter_c_sharp.Language()), nil
+	case "css":
+		return sitter.NewLanguage(sitter_css.Language()), nil
+	case "go":
+		return sitter.NewLanguage(sitter_go.Language()), nil
+	case "java":
+		return sitter.NewLanguage(sitter_java.Language()), nil
+	case "javascript":
+		return sitter.NewLanguage(sitter_javascript.Language()), nil
+	case "html":
+		return sitter.NewLanguage(sitter_html.Language()), nil
+	case "python":
+		return sitter.NewLanguage(sitter_python.Language()), nil
+	case "typescript":
+		return sitter.NewLanguage(sitter_typescript.LanguageTypescript()), nil
+	case "tsx":
+		// TSX is a separate dialect with its own language object in the binding.
+		return sitter.NewLanguage(sitter_typescript.LanguageTSX()), nil
+	case "rust":
+		return sitter.NewLanguage(sitter_rust.Language()), nil
+	default:
+		// c, cpp, json, yaml, dockerfile, gomod, gosum, make etc. are recognized but no
+		// grammar is vendored yet.
+		return nil, fmt.Errorf("%w: %s", ErrorUnsupportedLanguage, lang)
+	}
+}
+
+// shebangInterpreters maps the interpreter named by a "#!" line to a language name.
+var shebangInterpreters = map[string]string{
+	"sh":      "bash",
+	"bash":    "bash",
+	"dash":    "bash",
+	"ksh":     "bash",
+	"zsh":     "bash",
+	"python":  "python",
+	"python2": "python",
+	"python3": "python",
+	"node":    "javascript",
+	"nodejs":  "javascript",
+}
+
+// goPackageClause matches a Go package clause on a line of its own.
+var goPackageClause = regexp.MustCompile(`^package [A-Za-z_][A-Za-z0-9_]*\s*(//.*)?$`)
+
+// detectLanguage guesses the language name of a file whose name gave nothing away from its
+// first lines: a "#!" interpreter, a Go package clause or an HTML doctype. It is
+// deliberately conservative and returns "" when unsure.
+func detectLanguage(source []byte) string {
+	source = bytes.TrimPrefix(source, utf8BOM)
+	if bytes.HasPrefix(source, []byte("#!")) {
+		fields := strings.Fields(string(firstLine(source[2:])))
+		if len(fields) == 0 {
+			return ""
+		}
+		interpreter := filepath.Base(fields[0])
+		if interpreter == "env" {
+			// #!/usr/bin/env [-S] python3
+			interpreter = ""
+			for _, f := range fields[1:] {
+				if !strings.HasPrefix(f, "-") {
+					interpreter = f
+					break
+				}
+			}
+		}
+		return shebangInterpreters[interpreter]
+	}
+
+	// the first line of code decides; leading blank lines and comments are skipped
+	for rest := source; len(rest) > 0; {
+		line := firstLine(rest)
+		rest = rest[len(line):]
+		text := strings.TrimSpace(string(line))
+		switch {
+		case text == "" || strings.HasPrefix(text, "//"):
+			continue
+		case goPackageClause.MatchString(text):
+			return "go"
+		case len(text) >= 14 && strings.EqualFold(text[:14], "<!doctype html"), strings.HasPrefix(strings.ToLower(text), "<html"):
+			return "html"
+		}
+		return ""
+	}
+	return ""
+}
+
+// firstLine returns b up to and including its first newline.
+func firstLine(b []byte) []byte {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return b[:i+1]
+	}
+	return b
+}
+
+// patternCacheSize bounds the number of compiled patterns kept by compilePattern.
+const patternCacheSize = 256
+
+// patternKey identifies a compiled pattern in the cache.
+type patternKey struct {
+	pattern    string
+	ignoreCase bool
+}
+
+// patternCache holds compiled regular expressions shared by all TreeContexts.
+// A *regexp.Regexp is safe for concurrent use, so entries can be handed out freely.
+var patternCache = struct {
+	sync.Mutex
+	entries map[patternKey]*regexp.Regexp
+}{entries: make(map[patternKey]*regexp.Regexp)}
+
+// compilePattern compiles pat (case-insensitively if ignoreCase), reusing a cached result when possible.
+func compilePattern(pat string, ignoreCase bool) (*regexp.Regexp, error) {
+	// Lines are matched one at a time, where multi-line mode makes no difference.
+	pat = strings.TrimPrefix(pat, "(?m)")
+	key := patternKey{pattern: pat, ignoreCase: ignoreCase}
+
+	patternCache.Lock()
+	re, ok := patternCache.entries[key]
+	patternCache.Unlock()
+	if ok {
+		return re, nil
+	}
+
+	if ignoreCase {
+		// Go's regex doesn't have "IGNORECASE" as a flag (like Python),
+		// you compile different patterns or use (?i).
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, err
+	}
+
+	patternCache.Lock()
+	if len(patternCache.entries) >= patternCacheSize {
+		// simple eviction: start over rather than track recency
+		patternCache.entries = make(map[patternKey]*regexp.Regexp)
+	}
+	patternCache.entries[key] = re
+	patternCache.Unlock()
+
+	return re, nil
+}
+
+// binarySniffLen is the number of leading bytes inspected by detectBinary.
+const binarySniffLen = 8000
+
+// detectBinary reports whether source looks like binary content, i.e. contains
+// a NUL byte within its first binarySniffLen bytes (the same heuristic git uses).
+func detectBinary(source []byte) bool {
+	if len(source) > binarySniffLen {
+		source = source[:binarySniffLen]
+	}
+	return bytes.IndexByte(source, 0) >= 0
+}
+
+// wideRanges are the East Asian Wide and Fullwidth blocks, which terminals render two columns wide.
+var wideRanges = []struct{ lo, hi rune }{
+	{0x1100, 0x115F},   // Hangul Jamo initials
+	{0x2E80, 0x303E},   // CJK radicals, Kangxi, CJK symbols and punctuation
+	{0x3041, 0x33FF},   // Hiragana, Katakana, Bopomofo, CJK compatibility
+	{0x3400, 0x4DBF},   // CJK Extension A
+	{0x4E00, 0x9FFF},   // CJK Unified Ideographs
+	{0xA000, 0xA4CF},   // Yi
+	{0xAC00, 0xD7A3},   // Hangul syllables
+	{0xF900, 0xFAFF},   // CJK compatibility ideographs
+	{0xFE30, 0xFE4F},   // CJK compatibility forms
+	{0xFF00, 0xFF60},   // Fullwidth forms
+	{0xFFE0, 0xFFE6},   // Fullwidth signs
+	{0x1F300, 0x1F64F}, // Pictographs and emoticons
+	{0x1F900, 0x1F9FF}, // Supplemental symbols and pictographs
+	{0x20000, 0x3FFFD}, // CJK Extensions B and beyond
+}
+
+// runeWidth returns the number of terminal columns r occupies: 0 for combining marks and
+// other zero-width characters, 2 for wide East Asian characters and 1 otherwise.
+func runeWidth(r rune) int {
+	if r == 0 || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	for _, rng := range wideRanges {
+		if r >= rng.lo && r <= rng.hi {
+			return 2
 		}
 	}
+	return 1
+}
+
+// displayWidth returns the number of terminal columns s occupies; see runeWidth.
+func displayWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		width += runeWidth(r)
+	}
+	return width
+}
 
-	return nil, "", ErrorUnrecognizedFiletype
+// declarationKinds lists, per language, the node kinds treated as declarations.
+var declarationKinds = map[string][]string{
+	"bash":       {"function_definition"},
+	"c_sharp":    {"namespace_declaration", "file_scoped_namespace_declaration", "class_declaration", "interface_declaration", "struct_declaration", "enum_declaration", "record_declaration"},
+	"go":         {"function_declaration", "method_declaration", "type_declaration", "const_declaration", "var_declaration"},
+	"java":       {"class_declaration", "interface_declaration", "enum_declaration", "record_declaration", "annotation_type_declaration"},
+	"javascript": {"function_declaration", "generator_function_declaration", "class_declaration", "lexical_declaration", "variable_declaration", "export_statement"},
+	"python":     {"function_definition", "class_definition", "decorated_definition"},
+	"rust":       {"function_item", "struct_item", "enum_item", "union_item", "trait_item", "impl_item", "mod_item", "const_item", "static_item", "type_item", "macro_definition"},
+	"typescript": {"function_declaration", "generator_function_declaration", "class_declaration", "abstract_class_declaration", "interface_declaration", "type_alias_declaration", "enum_declaration", "lexical_declaration", "variable_declaration", "export_statement", "module"},
+	"tsx":        {"function_declaration", "generator_function_declaration", "class_declaration", "abstract_class_declaration", "interface_declaration", "type_alias_declaration", "enum_declaration", "lexical_declaration", "variable_declaration", "export_statement", "module"},
+}
+
+// commentKinds lists the comment node kinds of languages that don't just use "comment".
+var commentKinds = map[string]map[string]struct{}{
+	"java": {"line_comment": {}, "block_comment": {}},
+	"rust": {"line_comment": {}, "block_comment": {}},
+}
+
+// stringKinds lists, per language, the node kinds of string and character literals.
+var stringKinds = map[string]map[string]struct{}{
+	"bash":       {"string": {}, "raw_string": {}, "ansi_c_string": {}},
+	"c_sharp":    {"string_literal": {}, "verbatim_string_literal": {}, "raw_string_literal": {}, "interpolated_string_expression": {}, "character_literal": {}},
+	"css":        {"string_value": {}},
+	"go":         {"interpreted_string_literal": {}, "raw_string_literal": {}, "rune_literal": {}},
+	"html":       {"attribute_value": {}, "quoted_attribute_value": {}},
+	"java":       {"string_literal": {}, "character_literal": {}},
+	"javascript": {"string": {}, "template_string": {}},
+	"python":     {"string": {}},
+	"rust":       {"string_literal": {}, "raw_string_literal": {}, "char_literal": {}},
+	"typescript": {"string": {}, "template_string": {}},
+	"tsx":        {"string": {}, "template_string": {}},
+}
+
+// defaultCommentKinds is the comment node kind shared by most grammars.
+var defaultCommentKinds = map[string]struct{}{"comment": {}}
+
+// commentKindsFor returns the comment node kinds of lang.
+func commentKindsFor(lang string) map[string]struct{} {
+	if kinds, ok := commentKinds[lang]; ok {
+		return kinds
+	}
+	return defaultCommentKinds
 }
 
 // loadIgnoreList reads the ignore file and returns the list of patterns to ignore
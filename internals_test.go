@@ -1,9 +1,32 @@
 package grepast
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
+func TestLineStartOffsets(t *testing.T) {
+	for _, source := range []string{"", "\n", "a", "a\n", "a\nb", "a\r\n\nb\n\n"} {
+		tc := &TreeContext{source: []byte(source), lineStarts: lineStartOffsets([]byte(source))}
+		var got []string
+		for i := range tc.lineStarts {
+			got = append(got, string(tc.line(i)))
+		}
+		want := strings.Split(source, "\n")
+		if strings.Join(got, "|") != strings.Join(want, "|") || len(got) != len(want) {
+			t.Errorf("lines of %q = %q, want %q", source, got, want)
+		}
+	}
+
+	// lines are views into source rather than copies
+	tc := &TreeContext{source: []byte("one\ntwo")}
+	tc.lineStarts = lineStartOffsets(tc.source)
+	if &tc.line(1)[0] != &tc.source[4] {
+		t.Errorf("line 1 doesn't share source's memory")
+	}
+}
+
 func TestMatchIgnorePattern(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -190,6 +213,12 @@ func TestGetLanguageFromFileName(t *testing.T) {
 			expectedLang:  "python",
 			expectedError: nil,
 		},
+		{
+			name:          "Valid Python Stub File",
+			filePath:      "script.pyi",
+			expectedLang:  "python",
+			expectedError: nil,
+		},
 		{
 			name:          "Valid JavaScript File",
 			filePath:      "app.js",
@@ -199,8 +228,32 @@ func TestGetLanguageFromFileName(t *testing.T) {
 		{
 			name:          "Dockerfile",
 			filePath:      "Dockerfile",
-			expectedLang:  "Dockerfile",
-			expectedError: nil,
+			expectedLang:  "",
+			expectedError: ErrorUnsupportedLanguage,
+		},
+		{
+			name:          "go.mod",
+			filePath:      "/src/project/go.mod",
+			expectedLang:  "",
+			expectedError: ErrorUnsupportedLanguage,
+		},
+		{
+			name:          "go.sum",
+			filePath:      "go.sum",
+			expectedLang:  "",
+			expectedError: ErrorUnsupportedLanguage,
+		},
+		{
+			name:          "Makefile",
+			filePath:      "Makefile",
+			expectedLang:  "",
+			expectedError: ErrorUnsupportedLanguage,
+		},
+		{
+			name:          "go.work",
+			filePath:      "docs/go.work",
+			expectedLang:  "",
+			expectedError: ErrorUnsupportedLanguage,
 		},
 		{
 			name:          "Unsupported File",
@@ -210,9 +263,9 @@ func TestGetLanguageFromFileName(t *testing.T) {
 		},
 		{
 			name:          "File Without Extension",
-			filePath:      "Makefile",
+			filePath:      "LICENSE",
 			expectedLang:  "",
-			expectedError: ErrorUnsupportedLanguage,
+			expectedError: ErrorUnrecognizedFiletype,
 		},
 		{
 			name:          "Valid Go File",
@@ -228,10 +281,34 @@ func TestGetLanguageFromFileName(t *testing.T) {
 		},
 		{
 			name:          "Valid TypeScript File",
-			filePath:      "component.tsx",
+			filePath:      "service.ts",
+			expectedLang:  "typescript",
+			expectedError: nil,
+		},
+		{
+			name:          "Valid TypeScript ES Module File",
+			filePath:      "service.mts",
 			expectedLang:  "typescript",
 			expectedError: nil,
 		},
+		{
+			name:          "Valid TypeScript CommonJS File",
+			filePath:      "service.cts",
+			expectedLang:  "typescript",
+			expectedError: nil,
+		},
+		{
+			name:          "Valid TSX File",
+			filePath:      "component.tsx",
+			expectedLang:  "tsx",
+			expectedError: nil,
+		},
+		{
+			name:          "Valid JSX File",
+			filePath:      "component.jsx",
+			expectedLang:  "javascript",
+			expectedError: nil,
+		},
 	}
 
 	// Run test cases
@@ -240,20 +317,106 @@ func TestGetLanguageFromFileName(t *testing.T) {
 			lang, detectedLang, err := GetLanguageFromFileName(tt.filePath)
 
 			if tt.expectedError != nil {
-				if err == nil {
-					t.Errorf("expected an error but got none")
+				if !errors.Is(err, tt.expectedError) {
+					t.Errorf("expected error %v, got %v", tt.expectedError, err)
 				}
 			} else {
-				if err != nil && err != ErrorUnrecognizedFiletype {
+				if err != nil {
 					t.Errorf("unexpected error: %v", err)
 				}
 				if detectedLang != tt.expectedLang {
 					t.Errorf("expected language %q, got %q", tt.expectedLang, detectedLang)
 				}
-				if detectedLang != "Dockerfile" && lang == nil {
+				if lang == nil {
 					t.Errorf("expected a valid *sitter.Language instance, got nil")
 				}
 			}
 		})
 	}
 }
+
+func TestDetectBinary(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   []byte
+		expected bool
+	}{
+		{name: "Empty", source: []byte{}, expected: false},
+		{name: "Plain text", source: []byte("package main\n"), expected: false},
+		{name: "UTF-8 text", source: []byte("// héllo wörld\n"), expected: false},
+		{name: "NUL byte", source: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), expected: true},
+		{name: "NUL beyond sniff window", source: []byte(strings.Repeat("a", binarySniffLen) + "\x00"), expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectBinary(tt.source); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCompilePattern(t *testing.T) {
+	re1, err := compilePattern("foo", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	re2, _ := compilePattern("foo", false)
+	if re1 != re2 {
+		t.Errorf("expected the cached *regexp.Regexp to be reused")
+	}
+
+	reIgnore, _ := compilePattern("foo", true)
+	if reIgnore == re1 || !reIgnore.MatchString("FOO") {
+		t.Errorf("expected a separate case-insensitive entry")
+	}
+
+	if _, err := compilePattern("(", false); err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+}
+
+func TestDisplayWidth(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{in: "", want: 0},
+		{in: "needle", want: 6},
+		{in: "名前", want: 4},
+		{in: "ｆｕｌｌ", want: 8},
+		{in: "café", want: 4},
+		{in: "cafe\u0301", want: 4},
+		{in: "한글", want: 4},
+	}
+
+	for _, tt := range tests {
+		if got := displayWidth(tt.in); got != tt.want {
+			t.Errorf("displayWidth(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		{source: "#!/bin/sh\nexit 0\n", expected: "bash"},
+		{source: "#!/usr/bin/env -S python3 -u\n", expected: "python"},
+		{source: "#!/usr/bin/env node\n", expected: "javascript"},
+		{source: "#!/usr/bin/perl\n", expected: ""},
+		{source: "\n// hello\npackage main\n", expected: "go"},
+		{source: "package com.example;\n", expected: ""},
+		{source: "<!DOCTYPE html>\n<html></html>\n", expected: "html"},
+		{source: "package main is the entry point\n", expected: ""},
+		{source: "", expected: ""},
+	}
+
+	for _, tt := range tests {
+		if got := detectLanguage([]byte(tt.source)); got != tt.expected {
+			t.Errorf("detectLanguage(%q) = %q, want %q", tt.source, got, tt.expected)
+		}
+	}
+}
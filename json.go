@@ -0,0 +1,54 @@
+package grepast
+
+import "encoding/json"
+
+// Snippet is the JSON form of a TreeContext's current selection, as produced by MarshalJSON.
+// The field names and their meaning are stable.
+type Snippet struct {
+	Filename string `json:"filename"` // Name the context was created with.
+	Language string `json:"language"` // Detected (or overridden) language name, e.g. "go".
+	Hunks    []Hunk `json:"hunks"`    // Runs of consecutive shown lines, in file order; empty when nothing is shown.
+}
+
+// Hunk is a run of consecutive shown lines. Hidden lines (rendered as "⋮..." by Format)
+// fall between hunks.
+type Hunk struct {
+	StartLine int        `json:"start_line"` // 1-based number of the first line of the hunk.
+	Lines     []HunkLine `json:"lines"`      // The hunk's lines, in order.
+}
+
+// HunkLine is one shown source line.
+type HunkLine struct {
+	Line           int    `json:"line"`                       // 1-based line number.
+	Text           string `json:"text"`                       // Source text, without highlighting.
+	LineOfInterest bool   `json:"line_of_interest,omitempty"` // Whether the line is a line of interest.
+}
+
+// MarshalJSON implements json.Marshaler, encoding the lines Format would show as a Snippet.
+func (tc *TreeContext) MarshalJSON() ([]byte, error) {
+	return json.Marshal(tc.snippet())
+}
+
+// snippet groups the shown lines into hunks.
+func (tc *TreeContext) snippet() Snippet {
+	s := Snippet{Filename: tc.filename, Language: tc.language, Hunks: []Hunk{}}
+	if tc.blank {
+		return s
+	}
+
+	last := tc.lastRealLine()
+	prev := -2
+	for _, i := range tc.formatLines() {
+		if i < 0 || i > last {
+			continue
+		}
+		if i != prev+1 {
+			s.Hunks = append(s.Hunks, Hunk{StartLine: i + 1})
+		}
+		_, isLOI := tc.linesOfInterest[i]
+		hunk := &s.Hunks[len(s.Hunks)-1]
+		hunk.Lines = append(hunk.Lines, HunkLine{Line: i + 1, Text: string(tc.line(i)), LineOfInterest: isLOI})
+		prev = i
+	}
+	return s
+}
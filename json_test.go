@@ -0,0 +1,44 @@
+package grepast
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"needle\")\n}\n\nfunc other() {\n\tprintln(\"needle\")\n}\n")
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{Color: true, ShowParentContext: true, HeaderMax: 1})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+	tc.AddContext()
+
+	data, err := json.Marshal(tc)
+	assert.NoError(t, err)
+
+	var got Snippet
+	assert.NoError(t, json.Unmarshal(data, &got))
+	assert.Equal(t, Snippet{
+		Filename: "main.go",
+		Language: "go",
+		Hunks: []Hunk{
+			{StartLine: 3, Lines: []HunkLine{
+				{Line: 3, Text: "func main() {"},
+				{Line: 4, Text: "\tprintln(\"needle\")", LineOfInterest: true},
+			}},
+			{StartLine: 7, Lines: []HunkLine{
+				{Line: 7, Text: "func other() {"},
+				{Line: 8, Text: "\tprintln(\"needle\")", LineOfInterest: true},
+			}},
+		},
+	}, got)
+	assert.Contains(t, string(data), `"line_of_interest":true`)
+
+	// nothing selected still encodes an empty list of hunks
+	empty, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	data, err = json.Marshal(empty)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"filename":"main.go","language":"go","hunks":[]}`, string(data))
+}
@@ -0,0 +1,81 @@
+package grepast
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Parser builds TreeContexts for many files while reusing a single tree-sitter parser
+// and caching languages per extension. A Parser is not safe for concurrent use;
+// give each goroutine its own.
+type Parser struct {
+	parser    *sitter.Parser            // Reused tree-sitter parser.
+	current   *sitter.Language          // Language currently set on parser.
+	languages map[string]cachedLanguage // Resolved languages keyed by extension (or override).
+}
+
+// NewParser returns a Parser ready to parse files of any supported language.
+func NewParser() *Parser {
+	return &Parser{
+		parser:    sitter.NewParser(),
+		languages: make(map[string]cachedLanguage),
+	}
+}
+
+// Close releases the underlying tree-sitter parser. TreeContexts already produced remain valid.
+func (p *Parser) Close() {
+	if p.parser != nil {
+		p.parser.Close()
+		p.parser = nil
+	}
+}
+
+// Parse is the pooled equivalent of NewTreeContext.
+func (p *Parser) Parse(filename string, source []byte, options TreeContextOptions) (*TreeContext, error) {
+	lang, name, err := p.language(filename, source, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if lang != p.current {
+		if err := p.parser.SetLanguage(lang); err != nil {
+			// The grammar was generated with an ABI the binding cannot load.
+			return nil, fmt.Errorf("%w (%s): %v", ErrorParseFailed, filename, err)
+		}
+		p.current = lang
+	}
+	// Start from a clean state in case a previous parse was interrupted.
+	p.parser.Reset()
+
+	return newTreeContext(filename, name, source, p.parser, options)
+}
+
+// language returns the cached language (and its name) for filename, resolving it on first use.
+func (p *Parser) language(filename string, source []byte, options TreeContextOptions) (*sitter.Language, string, error) {
+	key := options.Language
+	if key == "" {
+		key = strings.ToLower(filepath.Ext(filename))
+	}
+	if cached, ok := p.languages[key]; ok && key != "" {
+		return cached.lang, cached.name, nil
+	}
+
+	lang, name, err := resolveLanguage(filename, source, options)
+	if err != nil {
+		return nil, "", err
+	}
+	if byExtension, ok := extensionMap[key]; options.Language != "" || (ok && name == byExtension) {
+		// files without a known extension are matched by name or content, so don't cache them
+		p.languages[key] = cachedLanguage{lang: lang, name: name}
+	}
+	return lang, name, nil
+}
+
+// cachedLanguage is a resolved language as stored by Parser.
+type cachedLanguage struct {
+	lang *sitter.Language
+	name string
+}
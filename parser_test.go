@@ -0,0 +1,70 @@
+package grepast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParser(t *testing.T) {
+	parser := NewParser()
+	defer parser.Close()
+
+	options := TreeContextOptions{ShowLineNumber: true, ShowParentContext: true, HeaderMax: 10}
+
+	files := []struct {
+		filename string
+		source   string
+	}{
+		{filename: "a.go", source: "package main\n\nfunc a() {\n\tneedle()\n}\n"},
+		{filename: "b.py", source: "def b():\n    needle()\n"},
+		{filename: "c.go", source: "package main\n\nfunc c() {\n\tneedle()\n}\n"},
+	}
+
+	for _, f := range files {
+		t.Run(f.filename, func(t *testing.T) {
+			pooled, err := parser.Parse(f.filename, []byte(f.source), options)
+			assert.NoError(t, err)
+			fresh, err := NewTreeContext(f.filename, []byte(f.source), options)
+			assert.NoError(t, err)
+
+			for _, tc := range []*TreeContext{pooled, fresh} {
+				tc.AddLinesOfInterest(tc.Grep("needle", false))
+				tc.AddContext()
+			}
+			assert.Equal(t, fresh.Format(), pooled.Format())
+			assert.Equal(t, fresh.SExpression(), pooled.SExpression())
+		})
+	}
+
+	_, err := parser.Parse("notes.xyz", []byte("x"), options)
+	assert.ErrorIs(t, err, ErrorUnrecognizedFiletype)
+}
+
+func BenchmarkNewTreeContextPerFile(b *testing.B) {
+	source := largeGoSource(5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tc, err := NewTreeContext("example.go", source, TreeContextOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		tc.Close()
+	}
+}
+
+func BenchmarkParserPooled(b *testing.B) {
+	source := largeGoSource(5)
+	parser := NewParser()
+	defer parser.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tc, err := parser.Parse("example.go", source, TreeContextOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		tc.Close()
+	}
+}
@@ -0,0 +1,22 @@
+; Definitions and references for Go, in the capture naming used by tree-sitter tags:
+; @name.definition.<kind> / @definition.<kind> and @name.reference.<kind> / @reference.<kind>.
+
+(function_declaration
+  name: (identifier) @name.definition.function) @definition.function
+
+(method_declaration
+  name: (field_identifier) @name.definition.method) @definition.method
+
+(type_spec
+  name: (type_identifier) @name.definition.type) @definition.type
+
+(const_spec
+  name: (identifier) @name.definition.constant) @definition.constant
+
+(call_expression
+  function: [
+    (identifier) @name.reference.call
+    (selector_expression field: (field_identifier) @name.reference.call)
+  ]) @reference.call
+
+(type_identifier) @name.reference.type
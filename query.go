@@ -0,0 +1,92 @@
+package grepast
+
+import (
+	"fmt"
+	"sync"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Capture is a node captured by a tree-sitter query.
+type Capture struct {
+	Name      string // Capture name without the "@", e.g. "name" for @name.
+	Kind      string // Kind of the captured node.
+	StartLine int    // 0-based line the node starts on.
+	EndLine   int    // 0-based line the node ends on.
+	Text      string // Source text of the node.
+}
+
+// queryKey identifies a compiled query in the cache.
+type queryKey struct {
+	language string
+	query    string
+}
+
+// queryCache holds compiled queries shared by all TreeContexts, for the life of the process
+// or until ClearQueryCache. A compiled query is read-only once built, so one can be used by
+// several cursors (and goroutines) at a time.
+var queryCache = struct {
+	sync.Mutex
+	entries map[queryKey]*sitter.Query
+}{entries: make(map[queryKey]*sitter.Query)}
+
+// RunQuery runs a tree-sitter query (S-expression pattern syntax) over the file and returns
+// its captures in document order. Compiled queries are cached per language and query text,
+// so running the same query over many files compiles it once. An invalid query returns an
+// error wrapping ErrorInvalidQuery with the offset and message from tree-sitter.
+func (tc *TreeContext) RunQuery(query string) ([]Capture, error) {
+	if tc.root == nil {
+		return nil, fmt.Errorf("%w (%s): context is closed", ErrorParseFailed, tc.filename)
+	}
+	q, err := compileQuery(tc.language, tc.root.Language(), query)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := sitter.NewQueryCursor()
+	defer cursor.Close()
+
+	names := q.CaptureNames()
+	var out []Capture
+	captures := cursor.Captures(q, tc.root, tc.source)
+	for match, index := captures.Next(); match != nil; match, index = captures.Next() {
+		c := match.Captures[index]
+		out = append(out, Capture{
+			Name:      names[c.Index],
+			Kind:      c.Node.Kind(),
+			StartLine: int(c.Node.StartPosition().Row),
+			EndLine:   int(c.Node.EndPosition().Row),
+			Text:      c.Node.Utf8Text(tc.source),
+		})
+	}
+	return out, nil
+}
+
+// ClearQueryCache closes and drops every cached compiled query, releasing their C memory.
+// It must not be called while RunQuery is running in another goroutine.
+func ClearQueryCache() {
+	queryCache.Lock()
+	defer queryCache.Unlock()
+	for key, q := range queryCache.entries {
+		q.Close()
+		delete(queryCache.entries, key)
+	}
+}
+
+// compileQuery compiles query for lang, reusing a cached result when possible.
+func compileQuery(name string, lang *sitter.Language, query string) (*sitter.Query, error) {
+	key := queryKey{language: name, query: query}
+
+	queryCache.Lock()
+	defer queryCache.Unlock()
+	if q, ok := queryCache.entries[key]; ok {
+		return q, nil
+	}
+
+	q, qerr := sitter.NewQuery(lang, query)
+	if qerr != nil {
+		return nil, fmt.Errorf("%w (offset %d): %v", ErrorInvalidQuery, qerr.Offset, qerr)
+	}
+	queryCache.entries[key] = q
+	return q, nil
+}
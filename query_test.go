@@ -0,0 +1,130 @@
+package grepast
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunQuery(t *testing.T) {
+	source := []byte("package main\n\nfunc alpha() {}\n\nfunc beta(\n\tx int,\n) {\n}\n")
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+
+	query := `(function_declaration name: (identifier) @name) @func`
+	captures, err := tc.RunQuery(query)
+	assert.NoError(t, err)
+	assert.Equal(t, []Capture{
+		{Name: "func", Kind: "function_declaration", StartLine: 2, EndLine: 2, Text: "func alpha() {}"},
+		{Name: "name", Kind: "identifier", StartLine: 2, EndLine: 2, Text: "alpha"},
+		{Name: "func", Kind: "function_declaration", StartLine: 4, EndLine: 7, Text: "func beta(\n\tx int,\n) {\n}"},
+		{Name: "name", Kind: "identifier", StartLine: 4, EndLine: 4, Text: "beta"},
+	}, captures)
+
+	t.Run("predicates", func(t *testing.T) {
+		captures, err := tc.RunQuery(`((identifier) @name (#eq? @name "beta"))`)
+		assert.NoError(t, err)
+		assert.Len(t, captures, 1)
+		assert.Equal(t, "beta", captures[0].Text)
+	})
+
+	t.Run("cached per language", func(t *testing.T) {
+		other, err := NewTreeContext("other.go", []byte("package other\n\nfunc gamma() {}\n"), TreeContextOptions{})
+		assert.NoError(t, err)
+		captures, err := other.RunQuery(query)
+		assert.NoError(t, err)
+		assert.Len(t, captures, 2)
+
+		queryCache.Lock()
+		_, ok := queryCache.entries[queryKey{language: "go", query: query}]
+		queryCache.Unlock()
+		assert.True(t, ok)
+	})
+
+	t.Run("invalid query", func(t *testing.T) {
+		_, err := tc.RunQuery(`(function_declaration name: (nope) @name)`)
+		assert.ErrorIs(t, err, ErrorInvalidQuery)
+		assert.ErrorContains(t, err, "offset 29")
+		assert.ErrorContains(t, err, "Invalid node type")
+
+		_, err = tc.RunQuery(`(function_declaration`)
+		assert.ErrorIs(t, err, ErrorInvalidQuery)
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		captures, err := tc.Clone().RunQuery(query)
+		assert.NoError(t, err)
+		assert.Len(t, captures, 4)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		closed, err := NewTreeContext("main.go", source, TreeContextOptions{})
+		assert.NoError(t, err)
+		closed.Close()
+		_, err = closed.RunQuery(query)
+		assert.ErrorIs(t, err, ErrorParseFailed)
+	})
+}
+
+func TestQueryCacheConcurrent(t *testing.T) {
+	ClearQueryCache()
+	query := `(call_expression function: (selector_expression field: (field_identifier) @call))`
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tc, err := NewTreeContext("main.go", largeGoSource(5), TreeContextOptions{})
+			assert.NoError(t, err)
+			defer tc.Close()
+			captures, err := tc.RunQuery(query)
+			assert.NoError(t, err)
+			assert.Len(t, captures, 5)
+		}()
+	}
+	wg.Wait()
+
+	queryCache.Lock()
+	assert.Len(t, queryCache.entries, 1)
+	queryCache.Unlock()
+
+	ClearQueryCache()
+	queryCache.Lock()
+	assert.Empty(t, queryCache.entries)
+	queryCache.Unlock()
+}
+
+// benchmarkRunQuery runs one query over many small files, optionally clearing the
+// query cache before each file to measure the cost of recompiling.
+func benchmarkRunQuery(b *testing.B, clear bool) {
+	query := `(function_declaration name: (identifier) @name parameters: (parameter_list) @params body: (block) @body)`
+	files := make([]*TreeContext, 50)
+	for i := range files {
+		tc, err := NewTreeContext(fmt.Sprintf("f%d.go", i), largeGoSource(5), TreeContextOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer tc.Close()
+		files[i] = tc
+	}
+	ClearQueryCache()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tc := range files {
+			if clear {
+				ClearQueryCache()
+			}
+			if _, err := tc.RunQuery(query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRunQueryCached(b *testing.B)   { benchmarkRunQuery(b, false) }
+func BenchmarkRunQueryUncached(b *testing.B) { benchmarkRunQuery(b, true) }
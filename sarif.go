@@ -0,0 +1,120 @@
+package grepast
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// sarifVersion and sarifSchema identify the SARIF format FormatSARIF produces.
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+)
+
+// The sarif* types are the subset of SARIF 2.1.0 that FormatSARIF fills in.
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndColumn   int `json:"endColumn"`
+}
+
+// FormatSARIF returns a SARIF 2.1.0 log with one ruleID result for every line of interest,
+// for tools that ingest static-analysis results. Each region is 1-based, with columns counted
+// in code points; it covers the first match span Grep recorded on the line, or the whole
+// trimmed line if there is none. An empty message is replaced by the region's text, or by
+// ruleID where that is empty too (a blank line of interest).
+func (tc *TreeContext) FormatSARIF(ruleID, message string) ([]byte, error) {
+	results := []sarifResult{}
+	for _, i := range tc.LinesOfInterest() {
+		if i < 0 || i > tc.lastRealLine() {
+			continue
+		}
+		line := strings.TrimSuffix(string(tc.line(i)), "\r")
+		start, end := len(line)-len(strings.TrimLeft(line, " \t")), len(strings.TrimRight(line, " \t"))
+		if spans := tc.Matches(i); len(spans) > 0 {
+			start, end = spans[0].Start, spans[0].End
+		}
+		// a blank line trims to nothing, and a span may reach into a trimmed "\r"
+		end = min(end, len(line))
+		start = min(start, end)
+		text := message
+		if text == "" {
+			text = line[start:end]
+		}
+		if text == "" {
+			text = ruleID
+		}
+		results = append(results, sarifResult{
+			RuleID:  ruleID,
+			Message: sarifMessage{Text: text},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(tc.filename)},
+				Region: sarifRegion{
+					StartLine:   i + 1,
+					StartColumn: utf8.RuneCountInString(line[:start]) + 1,
+					EndColumn:   utf8.RuneCountInString(line[:end]) + 1,
+				},
+			}}},
+		})
+	}
+
+	return json.MarshalIndent(sarifLog{
+		Version: sarifVersion,
+		Schema:  sarifSchema,
+		Runs: []sarifRun{{
+			Tool:       sarifTool{Driver: sarifDriver{Name: "grep-ast", Rules: []sarifRule{{ID: ruleID}}}},
+			ColumnKind: "unicodeCodePoints",
+			Results:    results,
+		}},
+	}, "", "  ")
+}
@@ -0,0 +1,105 @@
+package grepast
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatSARIF(t *testing.T) {
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"héllo\", needle)\n}\n\nvar x = 1\n")
+	tc, err := NewTreeContext("cmd/main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+	tc.AddLineOfInterest(6)
+
+	data, err := tc.FormatSARIF("grep-ast.match", "")
+	assert.NoError(t, err)
+
+	var log struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Name  string `json:"name"`
+					Rules []struct {
+						ID string `json:"id"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []struct {
+				RuleID  string `json:"ruleId"`
+				Message struct {
+					Text string `json:"text"`
+				} `json:"message"`
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct {
+							URI string `json:"uri"`
+						} `json:"artifactLocation"`
+						Region struct {
+							StartLine   int `json:"startLine"`
+							StartColumn int `json:"startColumn"`
+							EndColumn   int `json:"endColumn"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &log))
+	assert.Equal(t, "2.1.0", log.Version)
+	assert.Len(t, log.Runs, 1)
+	run := log.Runs[0]
+	assert.Equal(t, "grep-ast", run.Tool.Driver.Name)
+	assert.Equal(t, "grep-ast.match", run.Tool.Driver.Rules[0].ID)
+	assert.Len(t, run.Results, 2)
+
+	// the match: columns count code points, so é is one column
+	match := run.Results[0]
+	assert.Equal(t, "grep-ast.match", match.RuleID)
+	assert.Equal(t, "needle", match.Message.Text)
+	loc := match.Locations[0].PhysicalLocation
+	assert.Equal(t, "cmd/main.go", loc.ArtifactLocation.URI)
+	assert.Equal(t, 4, loc.Region.StartLine)
+	assert.Equal(t, 19, loc.Region.StartColumn)
+	assert.Equal(t, 25, loc.Region.EndColumn)
+
+	// a line added directly covers the whole line
+	added := run.Results[1]
+	assert.Equal(t, "var x = 1", added.Message.Text)
+	assert.Equal(t, 7, added.Locations[0].PhysicalLocation.Region.StartLine)
+	assert.Equal(t, 1, added.Locations[0].PhysicalLocation.Region.StartColumn)
+
+	// a given message is used as is
+	data, err = tc.FormatSARIF("rule", "found it")
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"text": "found it"`)
+
+	// no lines of interest still encodes an empty list of results
+	empty, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+	data, err = empty.FormatSARIF("rule", "")
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"results": []`)
+
+	// a blank line of interest has an empty region at its start
+	ws, err := NewTreeContext("main.go", []byte("package main\n    \nvar x = 1\r\n"), TreeContextOptions{})
+	assert.NoError(t, err)
+	ws.AddLineOfInterest(1)
+	ws.AddLinesOfInterest(ws.Grep(`1\r?$`, false))
+	data, err = ws.FormatSARIF("rule", "")
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &log))
+	assert.Len(t, log.Runs[0].Results, 2)
+	assert.Equal(t, "rule", log.Runs[0].Results[0].Message.Text, "an empty region falls back to the rule")
+	blank := log.Runs[0].Results[0].Locations[0].PhysicalLocation.Region
+	assert.Equal(t, 2, blank.StartLine)
+	assert.Equal(t, 1, blank.StartColumn)
+	assert.Equal(t, 1, blank.EndColumn)
+	crlf := log.Runs[0].Results[1]
+	assert.Equal(t, "1", crlf.Message.Text)
+	assert.Equal(t, 9, crlf.Locations[0].PhysicalLocation.Region.StartColumn)
+	assert.Equal(t, 10, crlf.Locations[0].PhysicalLocation.Region.EndColumn)
+}
@@ -0,0 +1,187 @@
+package grepast
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Symbol is a named definition found in the parse tree.
+type Symbol struct {
+	Name    string // Identifier of the definition.
+	Kind    string // Kind of definition, e.g. "func", "method", "class".
+	Line    int    // 0-based line the definition starts on.
+	EndLine int    // 0-based line the definition ends on.
+}
+
+// symbolKinds maps, per language, the node kinds of named definitions to a symbol kind.
+// The definition's name is read from the node's "name" field.
+var symbolKinds = map[string]map[string]string{
+	"bash": {
+		"function_definition": "function",
+	},
+	"c_sharp": {
+		"namespace_declaration":   "namespace",
+		"class_declaration":       "class",
+		"interface_declaration":   "interface",
+		"struct_declaration":      "struct",
+		"enum_declaration":        "enum",
+		"record_declaration":      "record",
+		"method_declaration":      "method",
+		"constructor_declaration": "constructor",
+	},
+	"go": {
+		"function_declaration": "func",
+		"method_declaration":   "method",
+		"type_spec":            "type",
+		"type_alias":           "type",
+	},
+	"java": {
+		"class_declaration":       "class",
+		"interface_declaration":   "interface",
+		"enum_declaration":        "enum",
+		"record_declaration":      "record",
+		"method_declaration":      "method",
+		"constructor_declaration": "constructor",
+	},
+	"javascript": {
+		"function_declaration":           "function",
+		"generator_function_declaration": "function",
+		"class_declaration":              "class",
+		"method_definition":              "method",
+	},
+	"python": {
+		"function_definition": "function",
+		"class_definition":    "class",
+	},
+	"rust": {
+		"function_item":    "function",
+		"struct_item":      "struct",
+		"enum_item":        "enum",
+		"union_item":       "union",
+		"trait_item":       "trait",
+		"mod_item":         "module",
+		"type_item":        "typedef",
+		"macro_definition": "macro",
+	},
+	"typescript": {
+		"function_declaration":           "function",
+		"generator_function_declaration": "function",
+		"class_declaration":              "class",
+		"abstract_class_declaration":     "class",
+		"method_definition":              "method",
+		"interface_declaration":          "interface",
+		"type_alias_declaration":         "type",
+		"enum_declaration":               "enum",
+	},
+}
+
+func init() {
+	// tsx shares typescript's definitions
+	symbolKinds["tsx"] = symbolKinds["typescript"]
+}
+
+// Symbols returns the named definitions in the file (functions, methods, types, classes, ...)
+// in source order, including nested ones such as methods inside a class.
+func (tc *TreeContext) Symbols() []Symbol {
+	var out []Symbol
+	tc.walkSymbols(func(node *sitter.Node, sym Symbol) {
+		out = append(out, sym)
+	})
+	return out
+}
+
+// walkSymbols calls fn, in source order, for every named definition and its node.
+func (tc *TreeContext) walkSymbols(fn func(node *sitter.Node, sym Symbol)) {
+	kinds := symbolKinds[tc.language]
+	if len(kinds) == 0 {
+		return
+	}
+
+	tc.Walk(func(node *sitter.Node, depth int) bool {
+		kind, ok := kinds[node.Kind()]
+		if !ok {
+			return true
+		}
+		if name := node.ChildByFieldName("name"); name != nil {
+			fn(node, Symbol{
+				Name:    name.Utf8Text(tc.source),
+				Kind:    kind,
+				Line:    int(node.StartPosition().Row),
+				EndLine: int(node.EndPosition().Row),
+			})
+		}
+		return true
+	})
+}
+
+// EnclosingScope returns the innermost named definition (function, method, class, ...) whose
+// lines include the 0-based line, and false if the line is outside every definition.
+func (tc *TreeContext) EnclosingScope(line int) (Symbol, bool) {
+	return enclosingSymbol(tc.Symbols(), line)
+}
+
+// enclosingSymbol returns the symbol with the smallest line range containing line.
+func enclosingSymbol(symbols []Symbol, line int) (Symbol, bool) {
+	var best Symbol
+	found := false
+	for _, sym := range symbols {
+		if line < sym.Line || line > sym.EndLine {
+			continue
+		}
+		if !found || sym.EndLine-sym.Line <= best.EndLine-best.Line {
+			best, found = sym, true
+		}
+	}
+	return best, found
+}
+
+// MatchContext describes one line of interest and the definition it sits in.
+type MatchContext struct {
+	Line    int      // 0-based line of interest.
+	Text    string   // Source text of the line.
+	Matches []string // Text of each match span recorded on the line by Grep; empty for lines added directly.
+	Scope   Symbol   // Innermost definition containing the line; valid if InScope.
+	InScope bool     // Whether the line is inside a definition at all.
+}
+
+// MatchContexts returns a MatchContext for every line of interest, in line order, e.g. to
+// group matches by function.
+func (tc *TreeContext) MatchContexts() []MatchContext {
+	symbols := tc.Symbols()
+	var out []MatchContext
+	for _, line := range tc.LinesOfInterest() {
+		if line < 0 || line >= len(tc.lineStarts) {
+			continue
+		}
+		mc := MatchContext{Line: line, Text: string(tc.line(line))}
+		for _, m := range tc.Matches(line) {
+			mc.Matches = append(mc.Matches, string(tc.line(line)[m.Start:m.End]))
+		}
+		mc.Scope, mc.InScope = enclosingSymbol(symbols, line)
+		out = append(out, mc)
+	}
+	return out
+}
+
+// WriteTags writes a tag line for every symbol to w in the classic ctags format,
+// name<TAB>file<TAB>/^line$/;"<TAB>kind, sorted by name as tag readers expect.
+func (tc *TreeContext) WriteTags(w io.Writer) error {
+	symbols := tc.Symbols()
+	sort.SliceStable(symbols, func(i, j int) bool { return symbols[i].Name < symbols[j].Name })
+
+	for _, sym := range symbols {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t/^%s$/;\"\t%s\n", sym.Name, tc.filename, tagPattern(string(tc.line(sym.Line))), sym.Kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagPattern escapes line for use inside a ctags /^...$/ search pattern.
+func tagPattern(line string) string {
+	return strings.NewReplacer(`\`, `\\`, `/`, `\/`).Replace(strings.TrimSuffix(line, "\r"))
+}
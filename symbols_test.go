@@ -0,0 +1,91 @@
+package grepast
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSymbols(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		source   string
+		want     []Symbol
+	}{
+		{
+			name:     "go",
+			filename: "main.go",
+			source:   "package main\n\ntype Server struct {\n\taddr string\n}\n\nfunc (s *Server) Run() {}\n\nfunc main() {\n\tfunc() {}()\n}\n",
+			want: []Symbol{
+				{Name: "Server", Kind: "type", Line: 2, EndLine: 4},
+				{Name: "Run", Kind: "method", Line: 6, EndLine: 6},
+				{Name: "main", Kind: "func", Line: 8, EndLine: 10},
+			},
+		},
+		{
+			name:     "python",
+			filename: "app.py",
+			source:   "class App:\n    def run(self):\n        pass\n\ndef main():\n    pass\n",
+			want: []Symbol{
+				{Name: "App", Kind: "class", Line: 0, EndLine: 2},
+				{Name: "run", Kind: "function", Line: 1, EndLine: 2},
+				{Name: "main", Kind: "function", Line: 4, EndLine: 5},
+			},
+		},
+		{
+			name:     "unsupported language",
+			filename: "style.css",
+			source:   "a { color: red; }\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTreeContext(tt.filename, []byte(tt.source), TreeContextOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tc.Symbols())
+		})
+	}
+}
+
+func TestWriteTags(t *testing.T) {
+	source := "package main\n\nfunc zeta() {}\n\nfunc alpha(path string) { // a/b\n}\n\ntype conf struct{}\n"
+	tc, err := NewTreeContext("cmd/main.go", []byte(source), TreeContextOptions{})
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tc.WriteTags(&buf))
+	assert.Equal(t, "alpha\tcmd/main.go\t/^func alpha(path string) { \\/\\/ a\\/b$/;\"\tfunc\n"+
+		"conf\tcmd/main.go\t/^type conf struct{}$/;\"\ttype\n"+
+		"zeta\tcmd/main.go\t/^func zeta() {}$/;\"\tfunc\n", buf.String())
+
+	assert.ErrorIs(t, tc.WriteTags(&failingWriter{limit: 10}), io.ErrShortWrite)
+}
+
+func TestMatchContexts(t *testing.T) {
+	source := "package main\n\nvar needle = 1\n\nfunc first() {\n\tuse(needle)\n}\n\ntype T struct{}\n\nfunc (T) second() {\n\tfunc() {\n\t\tuse(needle, needle)\n\t}()\n}\n"
+	tc, err := NewTreeContext("main.go", []byte(source), TreeContextOptions{})
+	assert.NoError(t, err)
+	tc.AddLinesOfInterest(tc.Grep("needle", false))
+
+	assert.Equal(t, []MatchContext{
+		{Line: 2, Text: "var needle = 1", Matches: []string{"needle"}},
+		{
+			Line: 5, Text: "\tuse(needle)", Matches: []string{"needle"},
+			Scope: Symbol{Name: "first", Kind: "func", Line: 4, EndLine: 6}, InScope: true,
+		},
+		{
+			Line: 12, Text: "\t\tuse(needle, needle)", Matches: []string{"needle", "needle"},
+			Scope: Symbol{Name: "second", Kind: "method", Line: 10, EndLine: 14}, InScope: true,
+		},
+	}, tc.MatchContexts())
+
+	scope, ok := tc.EnclosingScope(8)
+	assert.True(t, ok)
+	assert.Equal(t, "T", scope.Name)
+	_, ok = tc.EnclosingScope(0)
+	assert.False(t, ok)
+}
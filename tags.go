@@ -0,0 +1,54 @@
+package grepast
+
+import (
+	"embed"
+	"strings"
+)
+
+// tagsQueries holds the built-in tags queries, one queries/<language>-tags.scm per language.
+// Supporting a new language is a matter of adding its file.
+//
+//go:embed queries/*-tags.scm
+var tagsQueries embed.FS
+
+// TagsQuery returns the built-in tags query for the named language (e.g. "go"), if any.
+func TagsQuery(languageName string) (string, bool) {
+	data, err := tagsQueries.ReadFile("queries/" + languageName + "-tags.scm")
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Tags runs the language's built-in tags query and returns the definitions and references
+// it finds, in source order. Kind is the capture's role and kind, e.g. "definition.function"
+// or "reference.call"; a definition's EndLine is where the whole definition ends. Tags returns
+// nil for languages without a tags query.
+func (tc *TreeContext) Tags() []Symbol {
+	query, ok := TagsQuery(tc.language)
+	if !ok {
+		return nil
+	}
+	captures, err := tc.RunQuery(query)
+	if err != nil {
+		// the embedded queries are tested against their grammars
+		return nil
+	}
+
+	// captures are in document order, so a definition's node comes right before its name
+	enclosing := make(map[string]Capture)
+	var out []Symbol
+	for _, c := range captures {
+		kind, isName := strings.CutPrefix(c.Name, "name.")
+		if !isName {
+			enclosing[c.Name] = c
+			continue
+		}
+		sym := Symbol{Name: c.Text, Kind: kind, Line: c.StartLine, EndLine: c.EndLine}
+		if def, ok := enclosing[kind]; ok && def.StartLine <= c.StartLine && c.EndLine <= def.EndLine {
+			sym.EndLine = def.EndLine
+		}
+		out = append(out, sym)
+	}
+	return out
+}
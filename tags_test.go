@@ -0,0 +1,58 @@
+package grepast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagsQuery(t *testing.T) {
+	query, ok := TagsQuery("go")
+	assert.True(t, ok)
+	assert.Contains(t, query, "@name.definition.function")
+
+	_, ok = TagsQuery("cobol")
+	assert.False(t, ok)
+}
+
+func TestTags(t *testing.T) {
+	source := []byte(`package main
+
+const limit = 3
+
+type Server struct {
+	next *Server
+}
+
+func (s *Server) Run() {
+	helper()
+}
+
+func helper() {
+	fmt.Println(limit)
+}
+`)
+	tc, err := NewTreeContext("main.go", source, TreeContextOptions{})
+	assert.NoError(t, err)
+
+	var definitions []Symbol
+	for _, sym := range tc.Tags() {
+		if sym.Kind != "reference.call" && sym.Kind != "reference.type" {
+			definitions = append(definitions, sym)
+		}
+	}
+	assert.Equal(t, []Symbol{
+		{Name: "limit", Kind: "definition.constant", Line: 2, EndLine: 2},
+		{Name: "Server", Kind: "definition.type", Line: 4, EndLine: 6},
+		{Name: "Run", Kind: "definition.method", Line: 8, EndLine: 10},
+		{Name: "helper", Kind: "definition.function", Line: 12, EndLine: 14},
+	}, definitions)
+
+	assert.Contains(t, tc.Tags(), Symbol{Name: "helper", Kind: "reference.call", Line: 9, EndLine: 9})
+	assert.Contains(t, tc.Tags(), Symbol{Name: "Println", Kind: "reference.call", Line: 13, EndLine: 13})
+	assert.Contains(t, tc.Tags(), Symbol{Name: "Server", Kind: "reference.type", Line: 5, EndLine: 5})
+
+	py, err := NewTreeContext("main.py", []byte("def f():\n    pass\n"), TreeContextOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, py.Tags())
+}